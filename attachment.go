@@ -0,0 +1,266 @@
+package warded
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const attachmentDir = ".attachments"
+
+// Attachment describes a file attached to a passphrase.
+type Attachment struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// attachment is stored in the envelope of the passphrase it's attached to.
+// Every attachment is encrypted with its own random key,
+// so that it doesn't need to be re-encrypted by Rekey.
+type attachment struct {
+	Attachment
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+func (w Ward) attachmentPath(id string) string {
+	return filepath.Join(w.Dir, attachmentDir, id)
+}
+
+func newAttachmentID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (env envelope) attachment(name string) (int, error) {
+	for i, att := range env.Attachments {
+		if att.Name == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("Attachment %s doesn't exist", name)
+}
+
+// Attach encrypts everything read from in as an attachment named name.
+// An existing attachment with the same name is replaced.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) Attach(passName Name, name string, in io.Reader) error {
+	passName, env, err := w.resolve(passName)
+	if err != nil {
+		return err
+	}
+
+	att := attachment{
+		Attachment: Attachment{Name: name},
+		Key:        make([]byte, 32),
+	}
+	if att.ID, err = newAttachmentID(); err == nil {
+		_, err = io.ReadFull(rand.Reader, att.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = w.writeAttachmentFile(att.ID, func(out io.Writer) error {
+		enc, err := newStreamWriter(out, att.Key)
+		if err != nil {
+			return err
+		}
+		if att.Size, err = io.Copy(enc, in); err != nil {
+			return err
+		}
+		return enc.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	var replaced *attachment
+	if i, err := env.attachment(name); err == nil {
+		replaced = &attachment{}
+		*replaced = env.Attachments[i]
+		env.Attachments[i] = att
+	} else {
+		env.Attachments = append(env.Attachments, att)
+	}
+
+	if err = w.editEnvelope(passName, env); err != nil {
+		os.Remove(w.attachmentPath(att.ID))
+		return err
+	}
+	if replaced != nil {
+		return os.Remove(w.attachmentPath(replaced.ID))
+	}
+	return nil
+}
+
+// writeAttachmentFile writes an attachment file through a temporary file,
+// which is renamed into place once it has been written.
+func (w Ward) writeAttachmentFile(id string, write func(out io.Writer) error) error {
+	dir := filepath.Join(w.Dir, attachmentDir)
+	if err := w.mkdirAll(dir); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = w.Config.setPerms(tmp.Name(), w.Config.fileMode()); err == nil {
+		err = write(tmp)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.attachmentPath(id))
+}
+
+// Attachments lists the attachments of a passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) Attachments(passName Name) ([]Attachment, error) {
+	_, env, err := w.resolve(passName)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]Attachment, len(env.Attachments))
+	for i, att := range env.Attachments {
+		attachments[i] = att.Attachment
+	}
+	return attachments, nil
+}
+
+// GetAttachment decrypts an attachment to out.
+// An error is returned if the attachment has been modified or truncated,
+// although some of the decrypted content may have been written by then.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) GetAttachment(passName Name, name string, out io.Writer) error {
+	_, env, err := w.resolve(passName)
+	if err != nil {
+		return err
+	}
+
+	i, err := env.attachment(name)
+	if err != nil {
+		return err
+	}
+	att := env.Attachments[i]
+
+	file, err := os.Open(w.attachmentPath(att.ID))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	in, err := newStreamReader(file, att.Key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// RemoveAttachment removes an attachment from a passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) RemoveAttachment(passName Name, name string) error {
+	passName, env, err := w.resolve(passName)
+	if err != nil {
+		return err
+	}
+
+	i, err := env.attachment(name)
+	if err != nil {
+		return err
+	}
+	att := env.Attachments[i]
+	env.Attachments = append(env.Attachments[:i], env.Attachments[i+1:]...)
+
+	if err = w.editEnvelope(passName, env); err != nil {
+		return err
+	}
+	return os.Remove(w.attachmentPath(att.ID))
+}
+
+// removeReplacedAttachments removes the attachment files
+// of a replaced envelope that aren't used by the new one.
+func (w Ward) removeReplacedAttachments(old, env *envelope) error {
+	kept := make(map[string]bool, len(env.Attachments))
+	for _, att := range env.Attachments {
+		kept[att.ID] = true
+	}
+
+	for _, att := range old.Attachments {
+		if kept[att.ID] {
+			continue
+		}
+		if err := os.Remove(w.attachmentPath(att.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// duplicateAttachments copies every attachment file in the envelope
+// to a new ID, so that the envelope can be used by another passphrase.
+func (w Ward) duplicateAttachments(env *envelope) error {
+	for i, att := range env.Attachments {
+		id, err := newAttachmentID()
+		if err != nil {
+			return err
+		}
+
+		in, err := os.Open(w.attachmentPath(att.ID))
+		if err != nil {
+			return err
+		}
+		err = w.writeAttachmentFile(id, func(out io.Writer) error {
+			_, err := io.Copy(out, in)
+			return err
+		})
+		in.Close()
+		if err != nil {
+			return err
+		}
+		env.Attachments[i].ID = id
+	}
+	return nil
+}
+
+// copyAttachments copies the encrypted attachment files in the envelope
+// from another ward, unless they already exist.
+func (w Ward) copyAttachments(from Ward, env *envelope) error {
+	for _, att := range env.Attachments {
+		if _, err := os.Stat(w.attachmentPath(att.ID)); err == nil {
+			continue
+		}
+
+		in, err := os.Open(from.attachmentPath(att.ID))
+		if err != nil {
+			return err
+		}
+		err = w.writeAttachmentFile(att.ID, func(out io.Writer) error {
+			_, err := io.Copy(out, in)
+			return err
+		})
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package warded
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AuditIssue is a problem found with a passphrase by Audit.
+type AuditIssue struct {
+	Name    Name   `json:"name"`
+	Problem string `json:"problem"`
+}
+
+// Audit checks the passphrases matching the path pattern,
+// reporting those with fewer than minCodes unused recovery codes.
+// Aliases are skipped, since they're checked along with their target.
+func (w Ward) Audit(pathPattern string, minCodes int) ([]AuditIssue, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := make([]AuditIssue, 0)
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		if env.Alias != "" {
+			continue
+		}
+
+		entry := ParseEntry(env.Content)
+		if value, ok := entry.Field(recoveryCodesField); ok {
+			codes := parseRecoveryCodes(value)
+			if remaining := remainingCodes(codes); remaining < minCodes {
+				issues = append(issues, AuditIssue{
+					Name:    name,
+					Problem: fmt.Sprintf("%d of %d recovery codes left", remaining, len(codes)),
+				})
+			}
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].Name < issues[j].Name
+	})
+	return issues, nil
+}
@@ -0,0 +1,388 @@
+package warded
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version 1 bundles contain every file, while version 2 bundles
+// are followed by the attachments, which are encrypted as streams.
+const backupVersion = 2
+
+// Backup is the decrypted content of a backup bundle.
+// Files maps every file in the ward directory, including
+// the manifest and other metadata, to its content.
+// Attachments are too large to be kept in memory, so they're
+// listed in Streams and read from the bundle while restoring.
+// Config is the ward's configuration when it was backed up, of which
+// the key derivation and cipher are restored to the ward header.
+type Backup struct {
+	Created time.Time         `json:"created"`
+	Ward    string            `json:"ward"`
+	Config  WardConfig        `json:"config"`
+	Files   map[string][]byte `json:"files"`
+	Streams []BackupStream    `json:"streams,omitempty"`
+
+	in io.Reader
+}
+
+// BackupStream is a file that follows the bundle, encrypted
+// as a stream with its own key. Size is the size of the file.
+type BackupStream struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Key  []byte `json:"key"`
+}
+
+// SealedBackup is an encrypted backup bundle.
+// The bundle is encrypted with the master key, unless
+// SeparateKey is set, in which case it was encrypted with
+// a separate backup passphrase.
+type SealedBackup struct {
+	Version     int        `json:"version"`
+	SeparateKey bool       `json:"separateKey"`
+	Bundle      Passphrase `json:"bundle"`
+
+	in io.Reader
+}
+
+// Backup writes an encrypted and authenticated bundle
+// containing every file in the ward to out.
+// If backupKey is nil, the bundle is encrypted with the master key.
+// Attachments are streamed after the bundle, in constant memory.
+func (w Ward) Backup(out io.Writer, wardName string, backupKey []byte) error {
+	// the manifest is needed to verify the backup when restoring
+	if _, err := w.Manifest(); os.IsNotExist(err) && w.ExpectManifest {
+		return ErrManifestMissing
+	} else if os.IsNotExist(err) {
+		if err = w.ResetManifest(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	backup := Backup{
+		Created: time.Now().UTC(),
+		Ward:    wardName,
+		Config:  w.Config,
+		Files:   make(map[string][]byte),
+	}
+
+	err := filepath.Walk(w.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return err
+		}
+
+		rel, err := filepath.Rel(w.Dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if path.Dir(rel) == attachmentDir {
+			stream := BackupStream{Name: rel, Size: info.Size(), Key: make([]byte, 32)}
+			if _, err = io.ReadFull(rand.Reader, stream.Key); err == nil {
+				backup.Streams = append(backup.Streams, stream)
+			}
+			return err
+		}
+
+		backup.Files[rel], err = ioutil.ReadFile(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+
+	sealed := SealedBackup{
+		Version:     backupVersion,
+		SeparateKey: backupKey != nil,
+	}
+	if backupKey == nil {
+		backupKey = w.key
+	}
+
+	pass, err := sealPassphrase(w.Config, backupKey, plaintext)
+	if err != nil {
+		return err
+	}
+	sealed.Bundle = *pass
+
+	if err = json.NewEncoder(out).Encode(sealed); err != nil {
+		return err
+	}
+
+	for _, stream := range backup.Streams {
+		if err = w.backupStream(out, stream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupStream encrypts a file of the ward to out.
+func (w Ward) backupStream(out io.Writer, stream BackupStream) error {
+	in, err := os.Open(filepath.Join(w.Dir, filepath.FromSlash(stream.Name)))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	enc, err := newStreamWriter(out, stream.Key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(enc, in, stream.Size); err != nil {
+		return fmt.Errorf("%s changed during the backup", stream.Name)
+	}
+	return enc.Close()
+}
+
+// ReadBackup reads an encrypted backup bundle.
+// The bundle must be decrypted before it can be restored.
+// Any attachments are read from in while restoring.
+func ReadBackup(in io.Reader) (*SealedBackup, error) {
+	sealed := &SealedBackup{
+		Bundle: *defaultPassphrase(DefaultWardConfig()),
+	}
+
+	dec := json.NewDecoder(in)
+	if err := dec.Decode(sealed); err != nil {
+		return nil, err
+	}
+	if sealed.Version < 1 || sealed.Version > backupVersion {
+		return nil, fmt.Errorf("Unsupported backup version %d", sealed.Version)
+	}
+
+	// the streams follow the newline written after the bundle
+	sealed.in = io.MultiReader(dec.Buffered(), in)
+	newline := make([]byte, 1)
+	if _, err := io.ReadFull(sealed.in, newline); err == nil && newline[0] != '\n' {
+		return nil, errors.New("Invalid backup bundle")
+	}
+	return sealed, nil
+}
+
+// Decrypt authenticates and decrypts the bundle with the given key.
+// This is the master key, unless SeparateKey is set.
+func (s SealedBackup) Decrypt(key []byte) (*Backup, error) {
+	plaintext, err := s.Bundle.Decrypt(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt backup")
+	}
+
+	backup := &Backup{
+		Config: DefaultWardConfig(),
+		in:     s.in,
+	}
+	if err = json.Unmarshal(plaintext, backup); err != nil {
+		return nil, err
+	}
+
+	for _, stream := range backup.Streams {
+		if dir, id := path.Split(stream.Name); dir != attachmentDir+"/" || id == "" || isReserved(id) {
+			return nil, fmt.Errorf("Invalid attachment name %s in backup", stream.Name)
+		}
+	}
+	return backup, nil
+}
+
+// Verify checks that the backup contains the passphrases
+// listed in its manifest, using the master key to
+// authenticate the manifest.
+// Attachments are read from the bundle to check that they're intact,
+// so the backup can't be restored once it has been verified.
+func (b *Backup) Verify(masterKey []byte) (*ManifestStatus, error) {
+	status, err := b.verifyManifest(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.readStreams(func(stream BackupStream, in io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, in)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (b *Backup) verifyManifest(masterKey []byte) (*ManifestStatus, error) {
+	data, ok := b.Files[manifestName]
+	if !ok {
+		return nil, fmt.Errorf("Backup doesn't contain a manifest")
+	}
+
+	m, err := parseManifest(data)
+	if err == nil {
+		err = m.authenticate(masterKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the same rules are used to recognize passphrases as in the ward
+	filter := newIgnoreFilter(b.Config.Ignore, b.Files[ignoreName])
+	entries := make(map[string][]byte)
+	for name, content := range b.Files {
+		if !isReserved(name) && !filter.ignored(name) && isPassphrase(content) {
+			entries[filepath.FromSlash(name)] = contentSum(content)
+		}
+	}
+	return m.compare(entries), nil
+}
+
+// readStreams decrypts the streams that follow the bundle, in order.
+// An error is returned if any stream was modified or truncated.
+// The streams can only be read once.
+func (b *Backup) readStreams(fn func(stream BackupStream, in io.Reader) error) error {
+	if len(b.Streams) == 0 {
+		return nil
+	}
+	if b.in == nil {
+		return errors.New("Backup attachments have already been read")
+	}
+	in := b.in
+	b.in = nil
+
+	for _, stream := range b.Streams {
+		dec, err := newStreamReader(io.LimitReader(in, streamSize(stream.Size)), stream.Key)
+		if err == nil {
+			counted := &countingReader{in: dec}
+			if err = fn(stream, counted); err == nil && counted.n != stream.Size {
+				err = errStreamTruncated
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Attachment %s in backup: %s", stream.Name, err)
+		}
+	}
+	return nil
+}
+
+type countingReader struct {
+	in io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Restore writes the files in the backup to the ward directory,
+// using the key derivation and cipher stored in the backup.
+// The backup is verified against its manifest before anything is written,
+// and the ward directory must not contain any files.
+// The ward is restored to a temporary directory, which is only
+// renamed into place once every attachment has been verified.
+func (w Ward) Restore(b *Backup) error {
+	status, err := b.verifyManifest(w.key)
+	if err != nil {
+		return err
+	}
+	if !status.OK() {
+		return fmt.Errorf("Backup doesn't match its manifest")
+	}
+
+	for name := range b.Files {
+		if p := filepath.Join(w.Dir, filepath.FromSlash(name)); !strings.HasPrefix(p, w.Dir+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid file name %s in backup", name)
+		}
+	}
+
+	if files, err := ioutil.ReadDir(w.Dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("Ward directory %s isn't empty", w.Dir)
+	}
+
+	header, err := b.header()
+	if err != nil {
+		return err
+	}
+	w.Config = header.apply(w.Config)
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	if err = w.mkdirAll(filepath.Dir(w.Dir)); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(w.Dir), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmp := w
+	tmp.Dir = tmpDir
+	if err = w.Config.setPerms(tmpDir, w.Config.dirMode()); err != nil {
+		return err
+	}
+
+	for name, content := range b.Files {
+		if name == headerName {
+			continue
+		}
+		if err = tmp.writeFile(filepath.Join(tmpDir, filepath.FromSlash(name)), content); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Config.writeFileAtomic(filepath.Join(tmpDir, headerName), headerData, 0600); err != nil {
+		return err
+	}
+
+	err = b.readStreams(func(stream BackupStream, in io.Reader) error {
+		return tmp.writeAttachmentFile(path.Base(stream.Name), func(out io.Writer) error {
+			_, err := io.Copy(out, in)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(w.Dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(tmpDir, w.Dir)
+}
+
+// header returns the ward header to restore, which
+// is created from the backup's configuration if it has none.
+func (b Backup) header() (*Header, error) {
+	if data, ok := b.Files[headerName]; ok {
+		return parseHeader(data)
+	}
+	header := newHeader(b.Created, b.Config)
+	return &header, nil
+}
+
+// isReserved returns true if any element of the
+// slash-separated name starts with a dot.
+// These names are reserved for ward metadata.
+func isReserved(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package warded
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Character classes of the chars mode.
+const (
+	lowerChars   = "abcdefghijklmnopqrstuvwxyz"
+	upperChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars   = "0123456789"
+	specialChars = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+	// ambiguousChars look alike in many fonts
+	ambiguousChars = "O0Il1|"
+)
+
+// charClass is a class of characters, and the minimum
+// number of them that has to be in a password.
+type charClass struct {
+	name  string
+	chars []rune
+	min   uint
+}
+
+// classes returns the character classes of the policy, without any
+// excluded characters. Classes without characters are left out.
+func (p Policy) classes() ([]charClass, error) {
+	special := specialChars
+	if p.Special != nil {
+		special = *p.Special
+	}
+
+	exclude := p.Exclude
+	if p.NoAmbiguous {
+		exclude += ambiguousChars
+	}
+
+	seen := make(map[rune]bool)
+	var classes []charClass
+	total := uint(0)
+	for _, class := range []charClass{
+		{name: "lowercase", chars: []rune(lowerChars), min: p.MinLower},
+		{name: "uppercase", chars: []rune(upperChars), min: p.MinUpper},
+		{name: "digit", chars: []rune(digitChars), min: p.MinDigits},
+		{name: "special", chars: []rune(special), min: p.MinSpecial},
+	} {
+		// a character is only in the first class that contains it,
+		// such as letters given as special characters
+		chars := class.chars[:0:0]
+		for _, r := range class.chars {
+			if !seen[r] && !strings.ContainsRune(exclude, r) {
+				chars = append(chars, r)
+			}
+			seen[r] = true
+		}
+		class.chars = chars
+
+		if class.min > 0 && len(chars) == 0 {
+			return nil, fmt.Errorf("Generation policy excludes every %s character", class.name)
+		}
+		if p.NoRepeat && class.min > uint(len(chars)) {
+			return nil, fmt.Errorf("Generation policy needs %d %s characters without repeats, but only %d are allowed", class.min, class.name, len(chars))
+		}
+		if len(chars) > 0 {
+			classes = append(classes, class)
+			total += uint(len(chars))
+		}
+	}
+
+	minimum := p.MinLower + p.MinUpper + p.MinDigits + p.MinSpecial
+	if minimum > p.Length {
+		return nil, fmt.Errorf("Generation policy needs %d characters, but the length is %d", minimum, p.Length)
+	}
+	if p.NoRepeat && total < p.Length {
+		return nil, fmt.Errorf("Generation policy only allows %d characters without repeats, but the length is %d", total, p.Length)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Generation policy excludes every character")
+	}
+	return classes, nil
+}
+
+// generateChars generates a password that is chosen uniformly from every
+// password satisfying the policy, so that the minimum counts don't bias
+// which characters are used, or where they're placed.
+//
+// ways[i][r] is the number of ways to fill r positions with characters
+// from classes i and later, while satisfying their minimum counts.
+// The number of characters of each class is chosen in proportion to
+// the number of passwords with that count, followed by the positions
+// and the characters themselves.
+func (p Policy) generateChars() ([]byte, float64, error) {
+	classes, err := p.classes()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	length := int(p.Length)
+	ways := make([][]*big.Int, len(classes)+1)
+	for i := range ways {
+		ways[i] = make([]*big.Int, length+1)
+		for r := range ways[i] {
+			ways[i][r] = new(big.Int)
+		}
+	}
+	ways[len(classes)][0].SetInt64(1)
+
+	for i := len(classes) - 1; i >= 0; i-- {
+		for r := 0; r <= length; r++ {
+			for c := int(classes[i].min); c <= r; c++ {
+				ways[i][r].Add(ways[i][r], p.classWays(classes[i], r, c, ways[i+1][r-c]))
+			}
+		}
+	}
+	if ways[0][length].Sign() == 0 {
+		return nil, 0, fmt.Errorf("Generation policy can't be satisfied")
+	}
+
+	// positions that haven't been given a class yet
+	positions := make([]int, length)
+	for i := range positions {
+		positions[i] = i
+	}
+
+	password := make([]rune, length)
+	r := length
+	for i, class := range classes {
+		// choose the number of characters in the class
+		n, err := rand.Int(rand.Reader, ways[i][r])
+		if err != nil {
+			return nil, 0, err
+		}
+		c := int(class.min)
+		for ; c < r; c++ {
+			n.Sub(n, p.classWays(class, r, c, ways[i+1][r-c]))
+			if n.Sign() < 0 {
+				break
+			}
+		}
+
+		// choose the positions and characters of the class
+		err = shuffle(r, c, func(i, j int) { positions[i], positions[j] = positions[j], positions[i] })
+		if err != nil {
+			return nil, 0, err
+		}
+		chars := append([]rune(nil), class.chars...)
+		if p.NoRepeat {
+			err = shuffle(len(chars), c, func(i, j int) { chars[i], chars[j] = chars[j], chars[i] })
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		for k, pos := range positions[r-c : r] {
+			if p.NoRepeat {
+				password[pos] = chars[len(chars)-c+k]
+				continue
+			}
+			n, err := randIndex(len(chars))
+			if err != nil {
+				return nil, 0, err
+			}
+			password[pos] = chars[n]
+		}
+		r -= c
+	}
+
+	return []byte(string(password)), log2(ways[0][length]), nil
+}
+
+// classWays returns the number of ways to fill r positions with c characters
+// of the class, and the rest with the later classes, which can be filled
+// in rest ways: choose(r, c) * characters ** c * rest
+// Without repeats, the characters are chosen without replacement.
+func (p Policy) classWays(class charClass, r, c int, rest *big.Int) *big.Int {
+	ways := new(big.Int).Binomial(int64(r), int64(c))
+	size := int64(len(class.chars))
+	if p.NoRepeat {
+		if int64(c) > size {
+			return new(big.Int)
+		}
+		for k := int64(0); k < int64(c); k++ {
+			ways.Mul(ways, big.NewInt(size-k))
+		}
+	} else {
+		ways.Mul(ways, new(big.Int).Exp(big.NewInt(size), big.NewInt(int64(c)), nil))
+	}
+	return ways.Mul(ways, rest)
+}
+
+// shuffle moves k uniformly chosen elements of the first n
+// to positions n-k through n-1, in a uniformly random order.
+func shuffle(n, k int, swap func(i, j int)) error {
+	for i := n - 1; i >= n-k; i-- {
+		j, err := randIndex(i + 1)
+		if err != nil {
+			return err
+		}
+		swap(i, j)
+	}
+	return nil
+}
+
+// randIndex returns a uniformly random integer in [0, n).
+func randIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// log2 returns the base 2 logarithm of a positive integer,
+// which can be larger than a float64.
+func log2(x *big.Int) float64 {
+	shift := x.BitLen() - 64
+	if shift < 0 {
+		shift = 0
+	}
+	top, _ := new(big.Float).SetInt(new(big.Int).Rsh(x, uint(shift))).Float64()
+	return math.Log2(top) + float64(shift)
+}
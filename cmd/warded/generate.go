@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hexid/warded"
+)
+
+// lengthArg is the length argument of generate, which can be omitted,
+// in which case it's the name of the passphrase instead.
+type lengthArg struct {
+	length uint
+	name   warded.Name
+}
+
+func (a *lengthArg) Set(value string) error {
+	if length, err := strconv.ParseUint(value, 10, 0); err == nil {
+		a.length = uint(length)
+		return nil
+	}
+	return a.name.Set(value)
+}
+
+func (a *lengthArg) String() string {
+	if a.name != "" {
+		return a.name.String()
+	}
+	return strconv.FormatUint(uint64(a.length), 10)
+}
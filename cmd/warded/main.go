@@ -4,24 +4,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
+	"time"
 
 	"camlistore.org/pkg/misc/pinentry"
 
 	"github.com/cep21/xdgbasedir"
 	"github.com/daviddengcn/go-colortext"
-	"github.com/hexid/go-randstr"
 	"github.com/hexid/warded"
+	"github.com/hexid/warded/otp"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
-	ward warded.Ward
+	config      warded.Config
+	ward        warded.Ward
+	missingWard bool
 
 	pinRequest = pinentry.Request{
 		Desc:   "Warded Master Key",
@@ -29,66 +33,273 @@ var (
 	}
 	masterKey warded.Key
 
+	confirmPinRequest = pinentry.Request{
+		Desc:   "Confirm Warded Master Key",
+		Prompt: "Master Key",
+	}
+	backupPinRequest = pinentry.Request{
+		Desc:   "Warded Backup Passphrase",
+		Prompt: "Backup Passphrase",
+	}
+
 	app        = kingpin.New("warded", "A minimal passphrase manager using Chacha20-Poly1305")
 	help       = app.HelpFlag.Short('h')
 	wardName   = app.Flag("ward", "Ward group name").Short('w').Default("default").Envar("WARDED_NAME").String()
 	configPath = app.Flag("config", "Config file").Short('c').Envar("WARDED_CONFIG").String()
 	dataPath   = app.Flag("data", "Data directory").Short('d').Envar("WARDED_DATA").String()
+	statePath  = app.Flag("state", "State file used to detect rolled back wards").Envar("WARDED_STATE").String()
+
+	alias           = app.Command("alias", "Make a passphrase an alias to another passphrase").Action(loadMasterKey)
+	aliasPassName   = nameArg(alias.Arg("passName", "Alias passphrase name").Required())
+	aliasTargetName = nameArg(alias.Arg("targetPassName", "Passphrase name the alias points to").HintAction(listWard).Required())
+
+	attach         = app.Command("attach", "Attach a file to a passphrase").Action(loadMasterKey)
+	attachName     = attach.Flag("name", "Attachment name (default: the file name)").Short('n').String()
+	attachPassName = nameArg(attach.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	attachFile     = attach.Arg("file", "File to attach").Required().String()
 
-	copy             = app.Command("copy", "Copy a passphrase").Alias("cp")
-	copySrcPassName  = copy.Arg("srcPassName", "Source passphrase name").HintAction(listWard).Required().String()
-	copyDestPassName = copy.Arg("destPassName", "Destination passphrase name").Required().String()
+	attachment             = app.Command("attachment", "Manage attachments")
+	attachmentGet          = attachment.Command("get", "Write an attachment to a file or stdout").Action(loadMasterKey)
+	attachmentGetOut       = attachmentGet.Flag("out", "Output file").Short('o').String()
+	attachmentGetPassName  = nameArg(attachmentGet.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	attachmentGetName      = attachmentGet.Arg("name", "Attachment name").Required().String()
+	attachmentList         = attachment.Command("list", "List the attachments of a passphrase").Alias("ls").Action(loadMasterKey)
+	attachmentListPassName = nameArg(attachmentList.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	attachmentRm           = attachment.Command("remove", "Remove an attachment").Alias("rm").Action(loadMasterKey)
+	attachmentRmPassName   = nameArg(attachmentRm.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	attachmentRmName       = attachmentRm.Arg("name", "Attachment name").Required().String()
+
+	audit         = app.Command("audit", "Report passphrases that need attention").Action(loadMasterKey)
+	auditMinCodes = audit.Flag("min-codes", "Report passphrases with fewer unused recovery codes").Default("3").Int()
+	auditJSON     = audit.Flag("json", "Print the problems as JSON").Bool()
+	auditPath     = audit.Arg("path", "Passphrase path").String()
+
+	backup         = app.Command("backup", "Write an encrypted backup of the ward").Action(loadMasterKey)
+	backupOut      = backup.Flag("out", "Backup file").Short('o').Required().String()
+	backupSeparate = backup.Flag("passphrase", "Encrypt the backup with a separate backup passphrase").Short('p').Bool()
+
+	codes          = app.Command("codes", "Use the recovery codes of a passphrase").Action(loadMasterKey)
+	codesNext      = codes.Flag("next", "Print the next unused recovery code and mark it as used").Bool()
+	codesRemaining = codes.Flag("remaining", "Print the number of unused recovery codes").Bool()
+	codesPassName  = nameArg(codes.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+
+	copy             = app.Command("copy", "Copy a passphrase").Alias("cp").Action(loadMasterKey)
+	copySrcPassName  = nameArg(copy.Arg("srcPassName", "Source passphrase name").HintAction(listWard).Required())
+	copyDestPassName = nameArg(copy.Arg("destPassName", "Destination passphrase name").Required())
 
 	data         = app.Command("data", "Show remainder of lines starting with a given regexp").Action(loadMasterKey)
 	dataMaxMatch = data.Flag("max", "Match at most <MAX> line(s)").Short('m').Uint()
-	dataPassName = data.Arg("passName", "Passphrase name").HintAction(listWard).Required().String()
+	dataRaw      = data.Flag("raw", "Don't resolve references to other passphrases").Bool()
+	dataPassName = nameArg(data.Arg("passName", "Passphrase name").HintAction(listWard).Required())
 	dataRegexp   = data.Arg("regexp", "String that matches against the start of each line").Required().Regexp()
 
+	deleteWard      = app.Command("delete-ward", "Delete a ward and all of its passphrases").Action(loadMasterKey)
+	deleteWardForce = deleteWard.Flag("force", "Don't ask for confirmation").Short('f').Bool()
+	deleteWardName  = deleteWard.Arg("wardName", "Ward name").Required().String()
+
+	due       = app.Command("due", "List passphrases that are due to be rotated").Action(loadMasterKey)
+	dueWithin = due.Flag("within", "Include passphrases that are due within the given interval, such as 14d").Default("0s").String()
+	dueJSON   = due.Flag("json", "Print the passphrases as JSON").Bool()
+	duePath   = due.Arg("path", "Passphrase path").String()
+
 	edit         = app.Command("edit", "Edit passphrase").Action(loadMasterKey)
-	editPassName = edit.Arg("passName", "Passphrase name").HintAction(listWard).Required().String()
+	editPassName = nameArg(edit.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+
+	findURL      = app.Command("find-url", "Find passphrases with a url field matching a URL").Action(loadMasterKey)
+	findURLMatch = findURL.Flag("match", "How closely hosts have to match (default: domain)").Enum("exact", "subdomain", "domain")
+	findURLJSON  = findURL.Flag("json", "Print the matching passphrases as JSON").Bool()
+	findURLArg   = findURL.Arg("url", "URL to look up").Required().String()
 
-	generate         = app.Command("generate", "Generate passphrase")
-	generateSpecial  = generate.Flag("special", "Allowed special characters").Short('s').Default("\000").String()
-	generateLength   = generate.Arg("passLength", "Passphrase length").Required().Uint()
-	generatePassName = generate.Arg("passName", "Passphrase name").HintAction(listWard).Action(loadMasterKey).String()
+	generate           = app.Command("generate", "Generate passphrase")
+	generateProfile    = generate.Flag("profile", "Generation profile in the configuration (default: the profile of the passphrase's group)").Short('p').String()
+	generateSpecial    = generate.Flag("special", "Allowed special characters").Short('s').Default("\000").String()
+	generateMinLower   = generate.Flag("min-lower", "Minimum number of lowercase letters").Uint()
+	generateMinUpper   = generate.Flag("min-upper", "Minimum number of uppercase letters").Uint()
+	generateMinDigits  = generate.Flag("min-digits", "Minimum number of digits").Uint()
+	generateMinSpecial = generate.Flag("min-special", "Minimum number of special characters").Uint()
+	generateExclude    = generate.Flag("exclude", "Characters to exclude").String()
+	generateNoAmbig    = generate.Flag("no-ambiguous", "Exclude characters that look alike, such as O and 0").Bool()
+	generateNoRepeat   = generate.Flag("no-repeat", "Use every character at most once").Bool()
+	generateWords      = generate.Flag("words", "Generate a passphrase of the given number of words").Uint()
+	generateWordlist   = generate.Flag("wordlist", "File with one word on every line (default: the EFF large wordlist)").String()
+	generateSeparator  = generate.Flag("separator", "Separator between words or syllables (default: a space between words)").Default("\000").String()
+	generateCapitalize = generate.Flag("capitalize", "Capitalize every word").Bool()
+	generateDigits     = generate.Flag("digits", "Number of random digits to insert between words").Uint()
+	generateMask       = generate.Flag("mask", "Generate a passphrase matching a mask, such as ?u?l?l?d?d-?s").String()
+	generatePronounce  = generate.Flag("pronounceable", "Generate a pronounceable passphrase of random syllables").Bool()
+	generateSyllables  = generate.Flag("syllables", "Number of syllables of a pronounceable passphrase").Uint()
+	generateKeep       = generate.Flag("keep-previous", "Number of previous passwords to keep (default: keepPrevious in the configuration)").Default("-1").Int()
+	generateLength     = lengthArgOf(generate.Arg("passLength", "Passphrase length (default: the generate policy in the configuration)"))
+	generatePassName   = nameArg(generate.Arg("passName", "Passphrase name").HintAction(listWard))
 
 	grep           = app.Command("grep", "Search for text in the ward").Action(loadMasterKey)
 	grepIgnoreCase = grep.Flag("icase", "Ignore case when matching").Short('i').Bool()
+	grepTags       = grep.Flag("tag", "Only search passphrases matching the tag filter").Strings()
 	grepRegexp     = grep.Arg("regexp", "Search term").Required().Regexp()
 	grepPath       = grep.Arg("path", "Search path").String()
 
-	list     = app.Command("list", "List passphrases").Alias("ls")
-	listPath = list.Arg("path", "List path").String()
+	initWard = app.Command("init", "Initialize a new ward").Action(loadMasterKey)
+
+	list         = app.Command("list", "List passphrases").Alias("ls")
+	listClassify = list.Flag("classify", "Append @ to aliases").Short('F').Action(loadMasterKey).Bool()
+	listForeign  = list.Flag("foreign", "List files that aren't passphrases").Bool()
+	listTags     = list.Flag("tag", "Only list passphrases matching the tag filter, such as prod,staging or !legacy").Action(loadMasterKey).Strings()
+	listLong     = list.Flag("long", "Show when passphrases were created, modified and rotated").Short('l').Action(loadMasterKey).Bool()
+	listSort     = list.Flag("sort", "Sort by name, or from oldest to newest").Default("name").Action(loadMasterKey).Enum("name", "created", "modified", "rotated")
+	listPath     = list.Arg("path", "List path").String()
 
-	move             = app.Command("move", "Move a passphrase").Alias("mv")
-	moveSrcPassName  = move.Arg("srcPassName", "Source passphrase name").Required().String()
-	moveDestPassName = move.Arg("destPassName", "Destination passphrase name").Required().String()
+	move             = app.Command("move", "Move a passphrase").Alias("mv").Action(loadMasterKey)
+	moveSrcPassName  = nameArg(move.Arg("srcPassName", "Source passphrase name").Required())
+	moveDestPassName = nameArg(move.Arg("destPassName", "Destination passphrase name").Required())
+
+	newCmd      = app.Command("new", "Create a passphrase from a template using $EDITOR").Action(loadMasterKey)
+	newTemplate = newCmd.Flag("template", "Template name, such as login").Short('t').String()
+	newPassName = nameArg(newCmd.Arg("passName", "Passphrase name").Required())
+
+	otpCmd      = app.Command("otp", "Show the one-time password of the otpauth field of a passphrase").Action(loadMasterKey)
+	otpPeek     = otpCmd.Flag("peek", "Show the HOTP password without advancing the counter").Bool()
+	otpResync   = otpCmd.Flag("resync", "Resynchronize the HOTP counter with an observed password").PlaceHolder("CODE").String()
+	otpWindow   = otpCmd.Flag("window", "Number of counters to search when resynchronizing").Default("20").Uint64()
+	otpPassName = nameArg(otpCmd.Arg("passName", "Passphrase name").HintAction(listWard).Required())
 
 	rekey = app.Command("rekey", "Rekey all passphrases in the ward").Action(loadMasterKey)
 
-	remove         = app.Command("remove", "Remove a passphrase").Alias("rm")
-	removePassName = remove.Arg("passName", "Passphrase name").HintAction(listWard).Required().String()
+	renameWard        = app.Command("rename-ward", "Rename a ward")
+	renameWardName    = renameWard.Arg("wardName", "Ward name").Required().String()
+	renameWardNewName = renameWard.Arg("newWardName", "New ward name").Required().String()
+
+	refs         = app.Command("refs", "List references to a passphrase from other passphrases").Action(loadMasterKey)
+	refsPassName = nameArg(refs.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+
+	remove         = app.Command("remove", "Remove a passphrase").Alias("rm").Action(loadMasterKey)
+	removePassName = nameArg(remove.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+
+	restore       = app.Command("restore", "Restore a ward from an encrypted backup").Action(loadMasterKey)
+	restoreVerify = restore.Flag("verify", "Only verify the backup, without restoring it").Bool()
+	restoreFile   = restore.Arg("backupFile", "Backup file").Required().String()
+
+	set         = app.Command("set", "Set a field of a passphrase").Action(loadMasterKey)
+	setPassName = nameArg(set.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	setField    = set.Arg("field", "Field name").Required().String()
+	setValue    = set.Arg("value", "Field value").Required().String()
 
 	show          = app.Command("show", "Show passphrase").Action(loadMasterKey)
 	showOnlyFirst = show.Flag("first", "Show only the first line").Short('1').Bool()
-	showPassName  = show.Arg("passName", "Passphrase name").HintAction(listWard).Required().String()
+	showField     = show.Flag("field", "Show only the value of the given field").Short('f').String()
+	showRaw       = show.Flag("raw", "Don't resolve references to other passphrases").Bool()
+	showPrevious  = show.Flag("previous", "Show the Nth previous password, where 1 is the most recent").Int()
+	showPassName  = nameArg(show.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+
+	sshAgent         = app.Command("ssh-agent", "Serve the SSH keys in the ward with the SSH agent protocol")
+	sshAgentSocket   = sshAgent.Flag("socket", "Socket to listen on, or to lock (default: $SSH_AUTH_SOCK with --lock)").String()
+	sshAgentConfirm  = sshAgent.Flag("confirm", "Confirm every use of a key").Bool()
+	sshAgentLifetime = sshAgent.Flag("lifetime", "Remove keys from the agent after the given interval, such as 8h").Default("0s").String()
+	sshAgentLock     = sshAgent.Flag("lock", "Lock the running agent, wiping its keys").Bool()
+	sshAgentPath     = sshAgent.Arg("path", "Passphrase path").String()
 
 	stats     = app.Command("stats", "Get statistics on passphrases in the ward").Action(loadMasterKey)
 	statsJSON = stats.Flag("json", "Print the unprocessed statistics as JSON").Bool()
+	statsTags = stats.Flag("tag", "Only include passphrases matching the tag filter").Strings()
 	statsPath = stats.Arg("path", "Statistics path").String()
+
+	sync         = app.Command("sync", "Synchronize the ward with a copy in another data directory").Action(loadMasterKey)
+	syncDataPath = sync.Arg("otherDataDir", "Data directory containing the other copy of the ward").Required().String()
+
+	tag            = app.Command("tag", "Manage the tags of passphrases")
+	tagAdd         = tag.Command("add", "Add tags to a passphrase").Action(loadMasterKey)
+	tagAddPassName = nameArg(tagAdd.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	tagAddTags     = tagAdd.Arg("tags", "Tags").Required().Strings()
+	tagList        = tag.Command("list", "List the tags of passphrases").Alias("ls").Action(loadMasterKey)
+	tagListPath    = tagList.Arg("path", "List path").String()
+	tagRm          = tag.Command("remove", "Remove tags from a passphrase").Alias("rm").Action(loadMasterKey)
+	tagRmPassName  = nameArg(tagRm.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	tagRmTags      = tagRm.Arg("tags", "Tags").Required().Strings()
+
+	unset         = app.Command("unset", "Remove a field from a passphrase").Action(loadMasterKey)
+	unsetPassName = nameArg(unset.Arg("passName", "Passphrase name").HintAction(listWard).Required())
+	unsetField    = unset.Arg("field", "Field name").Required().String()
+
+	wards = app.Command("wards", "List wards and the number of passphrases in each")
+
+	verify       = app.Command("verify", "Verify the ward against its manifest").Action(loadMasterKey)
+	verifyAccept = verify.Flag("accept", "Accept the current contents of the ward as authentic").Bool()
 )
 
 func listWard() []string {
 	list, _ := ward.List("")
-	return list
+	names := make([]string, len(list))
+	for i, name := range list {
+		names[i] = string(name)
+	}
+	return names
+}
+
+// nameArg parses an argument as a passphrase name.
+func nameArg(arg *kingpin.ArgClause) *warded.Name {
+	name := new(warded.Name)
+	arg.SetValue(name)
+	return name
+}
+
+func sortNames(names []warded.Name) {
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+}
+
+func init() {
+	// added here, since these actions refer to the flags of their commands
+	generate.Action(loadGenerateKey)
+	sshAgent.Action(loadAgentKey)
+}
+
+// lengthArgOf parses the length argument of generate.
+func lengthArgOf(arg *kingpin.ArgClause) *lengthArg {
+	length := new(lengthArg)
+	arg.SetValue(length)
+	return length
+}
+
+// loadGenerateKey loads the master key if a passphrase is being generated
+// into the ward. The length can be omitted, in which case the name
+// of the passphrase is the first argument.
+func loadGenerateKey(ctx *kingpin.ParseContext) error {
+	if generateLength.name != "" {
+		if *generatePassName != "" {
+			return fmt.Errorf("Invalid passphrase length %s", generateLength.name)
+		}
+		*generatePassName = generateLength.name
+	}
+
+	if *generatePassName == "" {
+		return nil
+	}
+	return loadMasterKey(ctx)
+}
+
+// loadAgentKey loads the master key, unless an agent is being locked.
+func loadAgentKey(ctx *kingpin.ParseContext) error {
+	if *sshAgentLock {
+		return nil
+	}
+	return loadMasterKey(ctx)
 }
 
 func loadMasterKey(ctx *kingpin.ParseContext) (err error) {
-	masterKey, err = requestKey()
+	if masterKey == nil {
+		masterKey, err = requestKey(&pinRequest)
+	}
 	return
 }
-func requestKey() (key warded.Key, err error) {
-	if keyStr, err := pinRequest.GetPIN(); err == nil {
+
+// formatDate formats a date from passphrase metadata,
+// where a zero time means the date isn't known.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02")
+}
+func requestKey(req *pinentry.Request) (key warded.Key, err error) {
+	if keyStr, err := req.GetPIN(); err == nil {
 		key = []byte(keyStr)
 		err = key.Lock()
 	} else if err == pinentry.ErrCancel {
@@ -97,6 +308,37 @@ func requestKey() (key warded.Key, err error) {
 	return
 }
 
+// getPass returns the content of a passphrase, with its
+// references resolved unless raw is set.
+func getPass(passName warded.Name, raw bool) ([]byte, error) {
+	if raw {
+		return ward.Get(passName)
+	}
+	return ward.Resolve(passName)
+}
+
+// warnDangling warns about aliases and references that will be
+// left dangling by moving or removing a passphrase.
+// The warnings are best effort, so they never stop the change.
+func warnDangling(passName warded.Name) {
+	aliases, err := ward.AliasesTo(passName)
+	if err != nil {
+		warn("Can't check for aliases to %s: %s", passName, err)
+	}
+	sortNames(aliases)
+	for _, alias := range aliases {
+		warn("Alias %s will be left pointing to a missing passphrase", alias)
+	}
+
+	refs, err := ward.Refs(passName)
+	if err != nil {
+		warn("Can't check for references to %s: %s", passName, err)
+	}
+	for _, ref := range refs {
+		warn("Passphrase %s will be left with a broken reference to %s", ref.From, ref.To)
+	}
+}
+
 func main() {
 	if err := mainError(); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -107,7 +349,7 @@ func main() {
 func getWard(ctx *kingpin.ParseContext) error {
 	var err error
 
-	config := warded.Config{
+	config = warded.Config{
 		Ward: warded.DefaultWardConfig(),
 	}
 
@@ -117,6 +359,9 @@ func getWard(ctx *kingpin.ParseContext) error {
 		}
 		*configPath = path.Join(*configPath, "warded.json")
 	}
+	if *statePath == "" {
+		*statePath = path.Join(path.Dir(*configPath), "warded-state.json")
+	}
 	if configData, cfgErr := ioutil.ReadFile(*configPath); cfgErr == nil {
 		if cfgErr = json.Unmarshal(configData, &config); cfgErr != nil {
 			return cfgErr
@@ -131,56 +376,174 @@ func getWard(ctx *kingpin.ParseContext) error {
 		*dataPath = path.Join(dataDir, "warded")
 	}
 
-	wardDir := path.Join(*dataPath, *wardName)
-	if err = os.MkdirAll(wardDir, 0700); err != nil {
+	if err = checkWardName(*wardName); err != nil {
 		return err
 	}
-
-	ward = warded.NewWard()
-	ward.Config = config.GetWardConfig(*wardName)
-	ward.Dir = wardDir
+	wardDir := path.Join(*dataPath, *wardName)
+	ward, err = warded.OpenWard(wardDir, config.GetWardConfig(*wardName))
+	if err == warded.ErrNoWard {
+		// whether the command can be used without
+		// an existing ward is checked in mainError
+		missingWard = true
+		err = nil
+	}
 
 	return err
 }
 
+// requiresWard returns false for commands that can be
+// used without the selected ward existing.
+func requiresWard(command string) bool {
+	switch command {
+	case deleteWard.FullCommand(), initWard.FullCommand(), renameWard.FullCommand(),
+		restore.FullCommand(), wards.FullCommand():
+		return false
+	case generate.FullCommand():
+		return *generatePassName != ""
+	}
+	return true
+}
+
 func mainError() (err error) {
 	app.PreAction(getWard)
 	commands := kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	if missingWard && requiresWard(commands) {
+		return fmt.Errorf("Ward %s doesn't exist. Use `warded init` to create it", *wardName)
+	} else if !missingWard {
+		var warnings []string
+		if warnings, err = ward.CheckPermissions(); err != nil {
+			return
+		}
+		for _, warning := range warnings {
+			warn("%s", warning)
+		}
+	}
+
 	if masterKey != nil {
 		defer masterKey.Unlock()
 	}
 
 	ward.SetKey(masterKey)
 
+	var status *warded.ManifestStatus
+	if masterKey != nil {
+		if status, err = checkManifest(); err != nil {
+			return
+		}
+		defer func() {
+			if err == nil {
+				err = recordManifest(false)
+			}
+		}()
+	}
+
 	switch commands {
-	case copy.FullCommand():
-		var srcFile, destFile *os.File
-		var srcStat os.FileInfo
+	case alias.FullCommand():
+		err = ward.SetAlias(*aliasPassName, *aliasTargetName)
 
-		if srcFile, err = os.Open(ward.Path(*copySrcPassName)); err != nil {
+	case attach.FullCommand():
+		var in *os.File
+		if in, err = os.Open(*attachFile); err != nil {
 			return
 		}
-		defer srcFile.Close()
-		srcStat, err = srcFile.Stat()
-		if err != nil {
+		defer in.Close()
+
+		name := *attachName
+		if name == "" {
+			name = filepath.Base(*attachFile)
+		}
+		err = ward.Attach(*attachPassName, name, in)
+
+	case attachmentGet.FullCommand():
+		if *attachmentGetOut == "" {
+			err = ward.GetAttachment(*attachmentGetPassName, *attachmentGetName, os.Stdout)
 			return
 		}
 
-		destFile, err = os.OpenFile(ward.Path(*copyDestPassName),
-			os.O_CREATE|os.O_TRUNC|os.O_WRONLY, srcStat.Mode())
-		if err != nil {
+		var out *os.File
+		if out, err = os.OpenFile(*attachmentGetOut, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
 			return
 		}
-		defer destFile.Close()
+		defer out.Close()
 
-		if _, err = io.Copy(destFile, srcFile); err == nil {
-			err = destFile.Close()
+		if err = ward.GetAttachment(*attachmentGetPassName, *attachmentGetName, out); err == nil {
+			err = out.Close()
+		} else {
+			// don't leave behind an attachment that failed to decrypt
+			os.Remove(*attachmentGetOut)
+		}
+
+	case attachmentList.FullCommand():
+		var attachments []warded.Attachment
+		if attachments, err = ward.Attachments(*attachmentListPassName); err == nil {
+			for _, att := range attachments {
+				fmt.Printf("%s\t%d\n", att.Name, att.Size)
+			}
 		}
 
+	case attachmentRm.FullCommand():
+		err = ward.RemoveAttachment(*attachmentRmPassName, *attachmentRmName)
+
+	case audit.FullCommand():
+		var issues []warded.AuditIssue
+		if issues, err = ward.Audit(*auditPath, *auditMinCodes); err != nil {
+			return
+		}
+		if *auditJSON {
+			err = json.NewEncoder(os.Stdout).Encode(issues)
+			return
+		}
+
+		for _, issue := range issues {
+			fmt.Printf("%s\t%s\n", issue.Name, issue.Problem)
+		}
+
+	case backup.FullCommand():
+		var backupKey warded.Key
+		if *backupSeparate {
+			if backupKey, err = requestKey(&backupPinRequest); err != nil {
+				return
+			}
+			defer backupKey.Unlock()
+		}
+
+		var out *os.File
+		if out, err = os.OpenFile(*backupOut, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+			return
+		}
+		defer out.Close()
+
+		if err = ward.Backup(out, *wardName, backupKey); err == nil {
+			err = out.Close()
+		}
+
+	case codes.FullCommand():
+		if *codesNext {
+			var code string
+			var remaining int
+			if code, remaining, err = ward.NextRecoveryCode(*codesPassName); err == nil {
+				fmt.Println(code)
+				fmt.Fprintf(os.Stderr, "%d recovery codes left\n", remaining)
+			}
+			return
+		}
+
+		var remaining, total int
+		if remaining, total, err = ward.RecoveryCodes(*codesPassName); err == nil {
+			if *codesRemaining {
+				fmt.Println(remaining)
+			} else {
+				fmt.Printf("%d of %d recovery codes left\n", remaining, total)
+			}
+		}
+
+	case copy.FullCommand():
+		err = ward.Copy(*copySrcPassName, *copyDestPassName)
+
 	case data.FullCommand():
 		var pass []byte
-		if pass, err = ward.Get(*dataPassName); err == nil {
+		if pass, err = getPass(*dataPassName, *dataRaw); err == nil {
 			lines := bytes.Split(pass, []byte("\n"))
 			maxLines := *dataMaxMatch
 			check := maxLines > 0
@@ -199,6 +562,96 @@ func mainError() (err error) {
 			}
 		}
 
+	case deleteWard.FullCommand():
+		if err = checkWardName(*deleteWardName); err != nil {
+			return
+		}
+
+		var delWard warded.Ward
+		var passphrases []warded.Name
+		delDir := path.Join(*dataPath, *deleteWardName)
+		if delWard, err = warded.OpenWard(delDir, ward.Config); err != nil {
+			return
+		}
+
+		// unlike CheckKey, any key is rejected without a manifest,
+		// since it couldn't be checked against an empty ward
+		delWard.SetKey(masterKey)
+		if _, err = delWard.Manifest(); os.IsNotExist(err) {
+			return fmt.Errorf("Ward %s has no manifest to check the master key. Create one with `warded --ward %s verify --accept`", *deleteWardName, *deleteWardName)
+		} else if err == warded.ErrManifestMAC {
+			return fmt.Errorf("Invalid master key for ward %s", *deleteWardName)
+		} else if err != nil {
+			return
+		}
+		if passphrases, err = delWard.List(""); err != nil {
+			return
+		}
+
+		if !*deleteWardForce {
+			var res string
+			fmt.Printf("Delete ward %s and its %d passphrase(s)? (y/N) ", *deleteWardName, len(passphrases))
+			fmt.Scanln(&res)
+			if res != "y" && res != "Y" {
+				return fmt.Errorf("Ward not deleted")
+			}
+		}
+
+		if err = os.RemoveAll(delDir); err == nil {
+			err = moveState(delDir, "")
+		}
+
+	case due.FullCommand():
+		var within time.Duration
+		if within, err = warded.ParseInterval(*dueWithin); err != nil {
+			return
+		}
+
+		var rotations []warded.Rotation
+		if rotations, err = ward.Due(*duePath, within, time.Now()); err != nil {
+			return
+		}
+		if *dueJSON {
+			err = json.NewEncoder(os.Stdout).Encode(rotations)
+			return
+		}
+
+		for _, rotation := range rotations {
+			if rotation.Error != "" {
+				warn("%s", rotation.Error)
+				continue
+			}
+			state := "due"
+			if rotation.Overdue {
+				state = "overdue"
+			}
+			fmt.Printf("%-10s  %-7s  %s\n", formatDate(rotation.Due), state, rotation.Name)
+		}
+
+	case findURL.FullCommand():
+		match := *findURLMatch
+		if match == "" {
+			match = ward.Config.URLMatch
+		}
+
+		var strictness warded.URLStrictness
+		if strictness, err = warded.ParseURLStrictness(match); err != nil {
+			return
+		}
+
+		var matches []warded.URLMatch
+		if matches, err = ward.FindURL(*findURLArg, strictness); err != nil {
+			return
+		}
+		if *findURLJSON {
+			err = json.NewEncoder(os.Stdout).Encode(matches)
+			return
+		}
+
+		for _, match := range matches {
+			fmt.Printf("%-9s  %s\n", match.Match, match.Name)
+		}
+
 	case edit.FullCommand():
 		var pass, newPass []byte
 		if pass, err = ward.GetOrCheck(*editPassName); err != nil {
@@ -216,21 +669,87 @@ func mainError() (err error) {
 	case generate.FullCommand():
 		var oldPass []byte
 		var randStr []byte
-		var availRand string
+		var entropy float64
 
-		if *generateSpecial != "\000" {
-			availRand = (randstr.AlphaASCII | randstr.DigitASCII).String() + *generateSpecial
+		modes := 0
+		for _, set := range []bool{generateLength.length > 0, *generateWords > 0, *generateMask != "", *generatePronounce} {
+			if set {
+				modes++
+			}
+		}
+		if modes > 1 {
+			return fmt.Errorf("Only one of a passphrase length, --words, --mask and --pronounceable can be used")
+		}
 
-			// strip out any duplicate characters
-			availRand = string(uniqRunes([]rune(availRand)))
+		var policy warded.Policy
+		if *generateProfile != "" {
+			policy, err = ward.Config.Profile(*generateProfile)
+		} else if *generatePassName != "" {
+			policy, err = ward.Config.PolicyFor(*generatePassName)
 		} else {
-			availRand = randstr.RandASCII.String()
+			policy = ward.Config.GeneratePolicy()
+		}
+		if err != nil {
+			return
 		}
 
-		if randStr, err = randstr.Random(*generateLength, availRand); err == nil {
+		if generateLength.length > 0 {
+			policy.Mode = warded.ModeChars
+			policy.Length = generateLength.length
+		}
+		if *generateSpecial != "\000" {
+			policy.Special = generateSpecial
+		}
+		if *generateMinLower > 0 {
+			policy.MinLower = *generateMinLower
+		}
+		if *generateMinUpper > 0 {
+			policy.MinUpper = *generateMinUpper
+		}
+		if *generateMinDigits > 0 {
+			policy.MinDigits = *generateMinDigits
+		}
+		if *generateMinSpecial > 0 {
+			policy.MinSpecial = *generateMinSpecial
+		}
+		policy.Exclude += *generateExclude
+		policy.NoAmbiguous = policy.NoAmbiguous || *generateNoAmbig
+		policy.NoRepeat = policy.NoRepeat || *generateNoRepeat
+		if *generateWords > 0 {
+			policy.Mode = warded.ModeWords
+			policy.Words = *generateWords
+		}
+		if *generateMask != "" {
+			policy.Mode = warded.ModeMask
+			policy.Mask = *generateMask
+		}
+		if *generatePronounce {
+			policy.Mode = warded.ModePronounceable
+		}
+		if *generateSyllables > 0 {
+			policy.Syllables = *generateSyllables
+		}
+		if *generateWordlist != "" {
+			policy.Wordlist = *generateWordlist
+		}
+		if *generateSeparator != "\000" {
+			policy.Separator = generateSeparator
+		}
+		policy.Capitalize = policy.Capitalize || *generateCapitalize
+		if *generateDigits > 0 {
+			policy.Digits = *generateDigits
+		}
+
+		keep := ward.Config.KeepPrevious
+		if *generateKeep >= 0 {
+			keep = *generateKeep
+		}
+
+		if randStr, entropy, err = policy.Generate(); err == nil {
+			fmt.Fprintf(os.Stderr, "Entropy: %.1f bits\n", entropy)
 			if *generatePassName == "" {
 				fmt.Printf("Passphrase: %s\n", randStr)
-			} else if oldPass, err = ward.Update(*generatePassName, randStr); err == nil {
+			} else if oldPass, err = ward.UpdateKeeping(*generatePassName, randStr, keep); err == nil {
 				fmt.Printf("Old: %s\nNew: %s\n", oldPass, randStr)
 			}
 		}
@@ -243,7 +762,11 @@ func mainError() (err error) {
 				return err
 			}
 		}
-		results, err = ward.Search(*grepPath, *grepRegexp)
+		var filter warded.TagFilter
+		if filter, err = warded.ParseTagFilter(*grepTags); err != nil {
+			return
+		}
+		results, err = ward.Search(*grepPath, filter, *grepRegexp)
 		for _, res := range results {
 			ct.Foreground(ct.Blue, false)
 			fmt.Printf("%s:%d ", res.Passphrase, res.LineNum+1)
@@ -255,46 +778,353 @@ func mainError() (err error) {
 			fmt.Printf("%s\n", res.Line[res.IndexEnd:])
 		}
 
+	case initWard.FullCommand():
+		var confirmKey warded.Key
+		if confirmKey, err = requestKey(&confirmPinRequest); err != nil {
+			return
+		}
+		defer confirmKey.Unlock()
+
+		if !bytes.Equal(masterKey, confirmKey) {
+			err = fmt.Errorf("Master keys don't match")
+		} else if !missingWard {
+			err = fmt.Errorf("Ward %s already exists", *wardName)
+		} else if ward, err = warded.InitWard(ward.Dir, ward.Config, masterKey); err == nil {
+			fmt.Printf("Initialized ward %s\n", *wardName)
+		}
+
 	case list.FullCommand():
-		var passphrases []string
+		// passphrases are only filtered by tag when a filter is given
+		var tagged map[warded.Name]bool
+		if len(*listTags) > 0 {
+			var filter warded.TagFilter
+			var names []warded.Name
+			if filter, err = warded.ParseTagFilter(*listTags); err == nil {
+				names, err = ward.ListTagged(*listPath, filter)
+			}
+			if err != nil {
+				return
+			}
+
+			tagged = make(map[warded.Name]bool, len(names))
+			for _, name := range names {
+				tagged[name] = true
+			}
+		}
+		listed := func(name warded.Name) bool {
+			return tagged == nil || tagged[name]
+		}
+
+		if *listForeign {
+			var foreign []string
+			if foreign, err = ward.Foreign(*listPath); err == nil {
+				sort.Strings(foreign)
+
+				for _, name := range foreign {
+					fmt.Println(name)
+				}
+			}
+			return
+		}
+
+		if *listLong || *listSort != "name" {
+			var metadata map[warded.Name]warded.Metadata
+			if metadata, err = ward.MetadataMap(*listPath); err != nil {
+				return
+			}
+
+			names := make([]warded.Name, 0, len(metadata))
+			for name := range metadata {
+				if listed(name) {
+					names = append(names, name)
+				}
+			}
+			sortNames(names)
+
+			date := func(m warded.Metadata) time.Time {
+				switch *listSort {
+				case "created":
+					return m.Created
+				case "modified":
+					return m.Modified
+				case "rotated":
+					return m.Rotated
+				}
+				return time.Time{}
+			}
+			sort.SliceStable(names, func(i, j int) bool {
+				return date(metadata[names[i]]).Before(date(metadata[names[j]]))
+			})
+
+			for _, name := range names {
+				if m := metadata[name]; *listLong {
+					fmt.Printf("%-10s  %-10s  %-10s  %s\n", formatDate(m.Created), formatDate(m.Modified), formatDate(m.Rotated), name)
+				} else {
+					fmt.Println(name)
+				}
+			}
+			return
+		}
+
+		if *listClassify {
+			var passphrases []warded.Name
+			var aliases map[warded.Name]warded.Name
+			if passphrases, err = ward.List(*listPath); err == nil {
+				aliases, err = ward.Aliases(*listPath)
+			}
+			if err == nil {
+				names := make([]string, 0, len(passphrases))
+				for _, name := range passphrases {
+					if !listed(name) {
+						continue
+					}
+					if _, ok := aliases[name]; ok {
+						name += "@"
+					}
+					names = append(names, string(name))
+				}
+				sort.Strings(names)
+
+				for _, name := range names {
+					fmt.Println(name)
+				}
+			}
+			return
+		}
+
+		var passphrases []warded.Name
 		if passphrases, err = ward.List(*listPath); err == nil {
-			sort.Strings(passphrases)
+			sortNames(passphrases)
 
 			for _, name := range passphrases {
-				fmt.Println(name)
+				if listed(name) {
+					fmt.Println(name)
+				}
 			}
 		}
 
 	case move.FullCommand():
-		err = os.Rename(ward.Path(*moveSrcPassName), ward.Path(*moveDestPassName))
+		warnDangling(*moveSrcPassName)
+		err = ward.Move(*moveSrcPassName, *moveDestPassName)
+
+	case newCmd.FullCommand():
+		if _, err = ward.Get(*newPassName); err == nil {
+			err = fmt.Errorf("Passphrase %s already exists", *newPassName)
+			return
+		} else if !os.IsNotExist(err) {
+			return
+		} else if err = ward.CheckKey(); err != nil {
+			return
+		}
+
+		var template warded.Template
+		if *newTemplate != "" {
+			if template, err = config.Template(*newTemplate); err != nil {
+				return
+			}
+		}
+
+		var policy warded.Policy
+		if policy, err = ward.Config.PolicyFor(*newPassName); err != nil {
+			return
+		}
+
+		var entry *warded.Entry
+		if entry, err = template.Entry(policy, fillField); err != nil {
+			return
+		}
+
+		var pass []byte
+		if pass, err = editorTemp(entry.Bytes()); err == nil {
+			if err = ward.Edit(*newPassName, pass); err == nil {
+				fmt.Println("Created passphrase")
+			}
+		}
+
+	case otpCmd.FullCommand():
+		var key *otp.Key
+		if *otpResync != "" {
+			if key, err = ward.ResyncOTP(*otpPassName, *otpResync, *otpWindow); err == nil {
+				fmt.Printf("Resynchronized HOTP counter to %d\n", key.Counter)
+			}
+			return
+		}
+
+		var code string
+		if code, key, err = ward.OTP(*otpPassName, *otpPeek); err == nil {
+			fmt.Println(code)
+			if key.Type == otp.TypeTOTP {
+				remaining := (key.Remaining(time.Now()) + time.Second - 1) / time.Second
+				fmt.Fprintf(os.Stderr, "Valid for %ds\n", remaining)
+			}
+		}
 
 	case rekey.FullCommand():
 		var newMasterKey warded.Key
-		newMasterKey, err = requestKey()
+		newMasterKey, err = requestKey(&pinRequest)
 		if newMasterKey != nil {
 			defer newMasterKey.Unlock()
 		}
 		if err == nil {
-			err = ward.Rekey(newMasterKey, *dataPath)
+			if err = ward.Rekey(newMasterKey, *dataPath); err == nil {
+				ward.SetKey(newMasterKey)
+			}
+		}
+
+	case renameWard.FullCommand():
+		for _, name := range []string{*renameWardName, *renameWardNewName} {
+			if err = checkWardName(name); err != nil {
+				return
+			}
+		}
+
+		oldDir := path.Join(*dataPath, *renameWardName)
+		newDir := path.Join(*dataPath, *renameWardNewName)
+		if _, err = warded.OpenWard(oldDir, ward.Config); err != nil {
+			return
+		}
+		if _, err = os.Stat(newDir); err == nil {
+			return fmt.Errorf("Ward %s already exists", *renameWardNewName)
+		}
+
+		if err = os.Rename(oldDir, newDir); err == nil {
+			err = moveState(oldDir, newDir)
+		}
+
+	case refs.FullCommand():
+		var references []warded.Reference
+		if references, err = ward.Refs(*refsPassName); err == nil {
+			for _, ref := range references {
+				fmt.Printf("%s\t%s:%s\n", ref.From, ref.To, ref.Field)
+			}
 		}
 
 	case remove.FullCommand():
-		err = os.Remove(ward.Path(*removePassName))
+		warnDangling(*removePassName)
+		err = ward.Remove(*removePassName)
+
+	case restore.FullCommand():
+		var in *os.File
+		if in, err = os.Open(*restoreFile); err != nil {
+			return
+		}
+		defer in.Close()
+
+		var sealed *warded.SealedBackup
+		if sealed, err = warded.ReadBackup(in); err != nil {
+			return
+		}
+
+		backupKey := masterKey
+		if sealed.SeparateKey {
+			if backupKey, err = requestKey(&backupPinRequest); err != nil {
+				return
+			}
+			defer backupKey.Unlock()
+		}
+
+		var bak *warded.Backup
+		if bak, err = sealed.Decrypt(backupKey); err != nil {
+			return
+		}
+
+		if *restoreVerify {
+			var status *warded.ManifestStatus
+			if status, err = bak.Verify(masterKey); err != nil {
+				return
+			}
+			fmt.Printf("Ward: %s\nCreated: %s\nFiles: %d\nManifest version: %d\n",
+				bak.Ward, bak.Created.Local().Format(time.RFC1123), len(bak.Files)+len(bak.Streams), status.Version)
+			if !status.OK() {
+				err = fmt.Errorf("Backup doesn't match its manifest")
+			}
+		} else {
+			err = ward.Restore(bak)
+		}
+
+	case set.FullCommand():
+		err = ward.SetField(*setPassName, *setField, *setValue)
 
 	case show.FullCommand():
+		if *showPrevious != 0 {
+			var previous *warded.Previous
+			if previous, err = ward.PreviousPassword(*showPassName, *showPrevious); err == nil {
+				fmt.Println(previous.Password)
+				fmt.Fprintf(os.Stderr, "Replaced %s\n", previous.Replaced.Local().Format(time.RFC3339))
+			}
+			return
+		}
+
 		var pass []byte
-		if pass, err = ward.Get(*showPassName); err == nil {
-			if *showOnlyFirst {
-				if ind := bytes.IndexByte(pass, '\n') + 1; ind != 0 {
-					pass = pass[:ind]
-				}
+		if pass, err = getPass(*showPassName, *showRaw); err != nil {
+			return
+		}
+
+		if *showField != "" {
+			if value, ok := warded.ParseEntry(pass).Field(*showField); ok {
+				fmt.Println(value)
+			} else {
+				err = fmt.Errorf("Field %s doesn't exist in %s", *showField, *showPassName)
+			}
+			return
+		}
+
+		if *showOnlyFirst {
+			if ind := bytes.IndexByte(pass, '\n') + 1; ind != 0 {
+				pass = pass[:ind]
+			}
+		}
+		fmt.Println(string(pass[:]))
+
+	case sshAgent.FullCommand():
+		socket := *sshAgentSocket
+		if *sshAgentLock {
+			if socket == "" {
+				socket = os.Getenv("SSH_AUTH_SOCK")
+			}
+			if socket == "" {
+				err = fmt.Errorf("SSH_AUTH_SOCK isn't set. Use --socket to select the agent")
+				return
+			}
+			err = lockAgent(socket)
+			return
+		}
+
+		if socket == "" {
+			if socket, err = agentSocket(); err != nil {
+				return
 			}
-			fmt.Println(string(pass[:]))
 		}
 
+		options := warded.SSHAgentOptions{
+			Confirm:    *sshAgentConfirm,
+			ConfirmUse: confirmKey,
+		}
+		if options.Lifetime, err = warded.ParseInterval(*sshAgentLifetime); err != nil {
+			return
+		}
+
+		var sshKeys *warded.SSHAgent
+		if sshKeys, err = ward.NewSSHAgent(*sshAgentPath, options); err != nil {
+			return
+		}
+		defer sshKeys.Close()
+
+		// the agent doesn't need the master key once
+		// the keys are loaded, so it's wiped while serving
+		masterKey.Unlock()
+		keys, _ := sshKeys.List()
+		fmt.Fprintf(os.Stderr, "Serving %d SSH keys\n", len(keys))
+		err = serveAgent(sshKeys, socket)
+
 	case stats.FullCommand():
+		var filter warded.TagFilter
+		if filter, err = warded.ParseTagFilter(*statsTags); err != nil {
+			return
+		}
+
 		var statistics *warded.Statistics
-		if statistics, err = ward.Stats(*statsPath); err == nil {
+		if statistics, err = ward.Stats(*statsPath, filter); err == nil {
 			if *statsJSON {
 				var jsonStats []byte
 				jsonStats, err = json.Marshal(statistics)
@@ -329,6 +1159,104 @@ func mainError() (err error) {
 					float64(statistics.SumLength)/float64(statistics.Count))
 			}
 		}
+
+	case sync.FullCommand():
+		var host string
+		if host, err = os.Hostname(); err != nil {
+			return
+		}
+
+		other := warded.NewWard()
+		other.Config = ward.Config
+		other.Dir = path.Join(*syncDataPath, *wardName)
+
+		var result *warded.SyncResult
+		if result, err = ward.Sync(other, host); err != nil {
+			return
+		}
+		for _, name := range result.Pulled {
+			fmt.Printf("pulled\t%s\n", name)
+		}
+		for _, name := range result.Pushed {
+			fmt.Printf("pushed\t%s\n", name)
+		}
+		for _, name := range result.Deleted {
+			fmt.Printf("deleted\t%s\n", name)
+		}
+		for _, name := range result.Merged {
+			fmt.Printf("merged\t%s\n", name)
+		}
+		for _, name := range result.Conflicts {
+			fmt.Printf("conflict\t%s\t%s.conflict-%s\n", name, name, host)
+		}
+
+	case tagAdd.FullCommand():
+		err = ward.AddTags(*tagAddPassName, *tagAddTags...)
+
+	case tagList.FullCommand():
+		var tags map[warded.Name][]string
+		if tags, err = ward.Tags(*tagListPath); err == nil {
+			names := make([]warded.Name, 0, len(tags))
+			for name := range tags {
+				if len(tags[name]) > 0 {
+					names = append(names, name)
+				}
+			}
+			sortNames(names)
+
+			for _, name := range names {
+				fmt.Printf("%s\t%s\n", name, strings.Join(tags[name], ","))
+			}
+		}
+
+	case tagRm.FullCommand():
+		err = ward.RemoveTags(*tagRmPassName, *tagRmTags...)
+
+	case unset.FullCommand():
+		err = ward.UnsetField(*unsetPassName, *unsetField)
+
+	case wards.FullCommand():
+		var files []os.FileInfo
+		if files, err = ioutil.ReadDir(*dataPath); err != nil {
+			return
+		}
+
+		failed := false
+		for _, file := range files {
+			if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+
+			w, openErr := warded.OpenWard(path.Join(*dataPath, file.Name()), ward.Config)
+			if openErr == warded.ErrNoWard {
+				continue
+			}
+
+			var passphrases []warded.Name
+			if openErr == nil {
+				passphrases, openErr = w.List("")
+			}
+			if openErr != nil {
+				warn("Ward %s: %s", file.Name(), openErr)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s\t%d\n", file.Name(), len(passphrases))
+		}
+		if failed {
+			err = fmt.Errorf("Some wards couldn't be listed")
+		}
+
+	case verify.FullCommand():
+		if *verifyAccept {
+			if err = ward.ResetManifest(); err == nil {
+				err = recordManifest(true)
+			}
+			return
+		}
+		if status == nil || !status.OK() {
+			err = fmt.Errorf("Ward doesn't match its manifest")
+		}
 	}
 
 	return
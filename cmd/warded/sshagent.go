@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"camlistore.org/pkg/misc/pinentry"
+
+	"github.com/cep21/xdgbasedir"
+	"github.com/hexid/warded"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSocket returns the socket of the ward's SSH agent, in a directory
+// that's only accessible by the current user.
+func agentSocket() (string, error) {
+	dir, err := xdgbasedir.RuntimeDirectory()
+	if err != nil || dir == "" {
+		dir = os.TempDir()
+	}
+
+	dir = filepath.Join(dir, fmt.Sprintf("warded-%d", os.Getuid()))
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, *wardName+".ssh-agent"), nil
+}
+
+// confirmKey asks whether an SSH key can be used.
+func confirmKey(name warded.Name) bool {
+	req := pinentry.Request{
+		Desc:   fmt.Sprintf("Allow use of the SSH key %s?", name),
+		OK:     "Allow",
+		Cancel: "Deny",
+	}
+	_, err := req.GetPIN()
+	return err == nil
+}
+
+// serveAgent serves the agent on a unix socket,
+// until it's interrupted or terminated.
+func serveAgent(a *warded.SSHAgent, socket string) error {
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("An agent is already listening on %s", socket)
+	}
+	// remove the socket of an agent that didn't exit cleanly
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	if err = os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socket)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// the listener is only closed by a signal
+			return nil
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a, conn)
+		}()
+	}
+}
+
+// lockAgent locks the agent listening on the socket.
+func lockAgent(socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).Lock(nil)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hexid/warded"
+)
+
+// wardState holds the highest manifest version seen for each ward directory.
+// It's kept outside of the data directory, so that a ward
+// that has been rolled back to an older manifest can be detected.
+type wardState map[string]uint64
+
+func readState(fileName string) (wardState, error) {
+	state := make(wardState)
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return state, json.Unmarshal(data, &state)
+}
+
+func (s wardState) write(fileName string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0600)
+}
+
+// checkWardName returns an error if a ward name isn't a single,
+// non-reserved directory name, so that it can't lead outside
+// of the data directory.
+func checkWardName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("Invalid ward name %q", name)
+	}
+	return nil
+}
+
+// moveState moves the recorded version of a ward to a new directory.
+// The version is removed if newDir is empty.
+func moveState(oldDir, newDir string) error {
+	state, err := readState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	if version, ok := state[oldDir]; ok {
+		delete(state, oldDir)
+		if newDir != "" {
+			state[newDir] = version
+		}
+		return state.write(*statePath)
+	}
+	return nil
+}
+
+func warn(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", a...)
+}
+
+// checkManifest prints a warning for every difference
+// between the ward and its manifest.
+// The status is nil if the manifest couldn't be verified.
+func checkManifest() (*warded.ManifestStatus, error) {
+	state, err := readState(*statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// a ward that has been seen with a manifest must keep it,
+	// so that a removed manifest isn't recreated from the ward as it is
+	ward.ExpectManifest = state[ward.Dir] > 0
+
+	status, err := ward.Verify()
+	if os.IsNotExist(err) && ward.ExpectManifest {
+		warn("Ward manifest has been removed, after version %d was seen. "+
+			"Check the ward, then accept its contents with `warded --ward %s verify --accept`", state[ward.Dir], *wardName)
+		return nil, nil
+	} else if os.IsNotExist(err) {
+		if passphrases, _ := ward.List(""); len(passphrases) > 0 {
+			warn("Ward has no manifest. One will be created by the next change")
+		}
+		return nil, nil
+	} else if err != nil {
+		warn("%s", err)
+		return nil, nil
+	}
+
+	for _, name := range status.Missing {
+		warn("Missing passphrase %s", name)
+	}
+	for _, name := range status.Unexpected {
+		warn("Unexpected passphrase %s", name)
+	}
+	for _, name := range status.Modified {
+		warn("Passphrase %s doesn't match the manifest", name)
+	}
+	status.CheckRollback(state[ward.Dir])
+	if status.RolledBackFrom > 0 {
+		warn("Ward was rolled back from version %d to %d", status.RolledBackFrom, status.Version)
+	}
+	return status, nil
+}
+
+// recordManifest stores the current manifest version of the ward.
+// Unless force is set, the version is only stored if it's newer.
+func recordManifest(force bool) error {
+	m, err := ward.Manifest()
+	if os.IsNotExist(err) || err == warded.ErrManifestMAC {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state, err := readState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	if force || m.Version > state[ward.Dir] {
+		state[ward.Dir] = m.Version
+		return state.write(*statePath)
+	}
+	return nil
+}
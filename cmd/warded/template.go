@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hexid/warded"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// fillField generates the value of a template field,
+// or prompts for it on stdin.
+func fillField(field warded.TemplateField, policy warded.Policy) (string, error) {
+	if field.Generate {
+		value, _, err := policy.Generate()
+		return string(value), err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: ", field.Name)
+	// fields are left empty once stdin is closed,
+	// so they can still be filled in with the editor
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,138 @@
+package warded
+
+import (
+	"fmt"
+	"strings"
+)
+
+// recoveryCodesField is the entry field holding one-time recovery codes,
+// separated by spaces or commas. Used codes are prefixed with usedCode.
+const (
+	recoveryCodesField = "recovery-codes"
+	usedCode           = "~"
+)
+
+// recoveryCode is a code of a recovery-codes field.
+// The separator before the code is kept, so that
+// the field is written back the way it was written.
+type recoveryCode struct {
+	Code string
+	Used bool
+	sep  string
+}
+
+func isCodeSeparator(r rune) bool {
+	return r == ' ' || r == ','
+}
+
+func parseRecoveryCodes(value string) []recoveryCode {
+	var codes []recoveryCode
+	for {
+		start := strings.IndexFunc(value, func(r rune) bool { return !isCodeSeparator(r) })
+		if start < 0 {
+			return codes
+		}
+		end := strings.IndexFunc(value[start:], isCodeSeparator)
+		if end < 0 {
+			end = len(value) - start
+		}
+
+		field := value[start : start+end]
+		codes = append(codes, recoveryCode{
+			Code: strings.TrimPrefix(field, usedCode),
+			Used: strings.HasPrefix(field, usedCode),
+			sep:  value[:start],
+		})
+		value = value[start+end:]
+	}
+}
+
+func formatRecoveryCodes(codes []recoveryCode) string {
+	var b strings.Builder
+	for _, code := range codes {
+		b.WriteString(code.sep)
+		if code.Used {
+			b.WriteString(usedCode)
+		}
+		b.WriteString(code.Code)
+	}
+	return b.String()
+}
+
+// remainingCodes returns the number of unused codes.
+func remainingCodes(codes []recoveryCode) int {
+	remaining := 0
+	for _, code := range codes {
+		if !code.Used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// RecoveryCodes returns the number of unused recovery codes
+// of a passphrase, and the total number of codes.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) RecoveryCodes(passName Name) (int, int, error) {
+	entry, err := w.GetEntry(passName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	value, ok := entry.Field(recoveryCodesField)
+	if !ok {
+		return 0, 0, fmt.Errorf("Passphrase %s doesn't have a %s field", passName, recoveryCodesField)
+	}
+	codes := parseRecoveryCodes(value)
+	return remainingCodes(codes), len(codes), nil
+}
+
+// NextRecoveryCode returns the first unused recovery code
+// of a passphrase and marks it as used, along with the number
+// of codes that remain unused.
+// The passphrase file is replaced atomically, so a code is never
+// returned without also being marked, and it's locked while the code
+// is marked, so that concurrent calls never return the same code.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) NextRecoveryCode(passName Name) (string, int, error) {
+	name, _, err := w.resolve(passName)
+	if err != nil {
+		return "", 0, err
+	}
+	unlock, err := w.lockPassphrase(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer unlock()
+
+	// the passphrase is read again, since it may have changed
+	// before the lock was taken
+	name, env, err := w.resolve(name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	entry := ParseEntry(env.Content)
+	value, ok := entry.Field(recoveryCodesField)
+	if !ok {
+		return "", 0, fmt.Errorf("Passphrase %s doesn't have a %s field", passName, recoveryCodesField)
+	}
+
+	codes := parseRecoveryCodes(value)
+	for i := range codes {
+		if codes[i].Used {
+			continue
+		}
+
+		codes[i].Used = true
+		if err = entry.SetField(recoveryCodesField, formatRecoveryCodes(codes)); err != nil {
+			return "", 0, err
+		}
+		env.Content = entry.Bytes()
+		if err = w.editEnvelope(name, env); err != nil {
+			return "", 0, err
+		}
+		return codes[i].Code, remainingCodes(codes), nil
+	}
+	return "", 0, fmt.Errorf("Passphrase %s has no recovery codes left", passName)
+}
@@ -5,9 +5,29 @@ import (
 )
 
 // WardConfig contains the configuration for the ward
+// Files and directories are only accessible by the current user,
+// unless GroupRead is set. Group is the name or ID of the group
+// that should own the files.
+// Files matching the Ignore patterns are never treated as passphrases.
+// RotateEvery maps a group name to how often the passphrases in it
+// have to be rotated, such as 90d, with "" applying to the entire ward.
+// URLMatch is the default strictness of find-url.
+// KeepPrevious is how many previous passwords generate keeps.
+// Generate is the default generation policy, such as the words mode.
+// Profiles are named generation policies, and GroupProfiles maps
+// a path pattern, such as banking/*, to the profile used for it.
 type WardConfig struct {
 	KeyDerivation KeyDerivationConfig `json:"keyDerivation"`
 	Cipher        string              `json:"cipher"`
+	GroupRead     bool                `json:"groupRead"`
+	Group         string              `json:"group,omitempty"`
+	Ignore        []string            `json:"ignore,omitempty"`
+	RotateEvery   map[string]string   `json:"rotateEvery,omitempty"`
+	URLMatch      string              `json:"urlMatch,omitempty"`
+	KeepPrevious  int                 `json:"keepPrevious,omitempty"`
+	Generate      *Policy             `json:"generate,omitempty"`
+	Profiles      map[string]Policy   `json:"profiles,omitempty"`
+	GroupProfiles map[string]string   `json:"groupProfiles,omitempty"`
 }
 
 // DefaultWardConfig returns the default WardConfig.
@@ -31,9 +51,11 @@ func DefaultWardConfig() WardConfig {
 // to the default ward configuration.
 // Wards is a map from ward name to configuration
 // and defaults to the general ward configuration.
+// Templates are added to, or replace, the default templates.
 type Config struct {
-	Ward  WardConfig            `json:"ward"`
-	Wards map[string]WardConfig `json:"wards"`
+	Ward      WardConfig            `json:"ward"`
+	Wards     map[string]WardConfig `json:"wards"`
+	Templates map[string]Template   `json:"templates,omitempty"`
 }
 
 // GetWardConfig returns the ward-specific configuration,
@@ -48,8 +70,9 @@ func (c Config) GetWardConfig(name string) WardConfig {
 // UnmarshalJSON unmarshals the warded configuration.
 func (c *Config) UnmarshalJSON(data []byte) error {
 	config := struct {
-		Ward  WardConfig                  `json:"ward"`
-		Wards map[string]*json.RawMessage `json:"wards"`
+		Ward      WardConfig                  `json:"ward"`
+		Wards     map[string]*json.RawMessage `json:"wards"`
+		Templates map[string]Template         `json:"templates"`
 	}{
 		Ward: DefaultWardConfig(),
 	}
@@ -58,6 +81,7 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 	}
 
 	c.Ward = config.Ward
+	c.Templates = config.Templates
 	if c.Wards == nil {
 		c.Wards = make(map[string]WardConfig)
 	}
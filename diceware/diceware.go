@@ -0,0 +1,125 @@
+// Package diceware generates passphrases from wordlists.
+package diceware
+
+import (
+	"bufio"
+	"crypto/rand"
+	_ "embed" // for the EFF wordlist
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// effLarge is the EFF large wordlist, with 7776 words.
+// https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases
+//
+//go:embed eff_large_wordlist.txt
+var effLarge string
+
+// EFFLarge returns the words of the EFF large wordlist.
+func EFFLarge() []string {
+	words, _ := ReadWordlist(strings.NewReader(effLarge))
+	return words
+}
+
+// ReadWordlist reads a wordlist with one word on every line.
+// Lines can start with dice rolls, as in the EFF wordlists,
+// which are separated from the word by whitespace.
+// Empty lines are skipped, and every word must be unique.
+func ReadWordlist(r io.Reader) ([]string, error) {
+	var words []string
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		word := fields[len(fields)-1]
+		if len(fields) > 2 || (len(fields) == 2 && strings.Trim(fields[0], "123456") != "") {
+			return nil, fmt.Errorf("Invalid wordlist line %q", scanner.Text())
+		}
+		if seen[word] {
+			return nil, fmt.Errorf("Word %s is in the wordlist more than once", word)
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(words) < 2 {
+		return nil, fmt.Errorf("Wordlist must contain at least 2 words")
+	}
+	return words, nil
+}
+
+// Options are the options for generating a passphrase.
+// Words is the number of words, which are joined by Separator.
+// Capitalize capitalizes the first letter of every word, and
+// Digits is the number of random digits inserted between words,
+// or at either end.
+type Options struct {
+	Words      uint
+	Separator  string
+	Capitalize bool
+	Digits     uint
+}
+
+// Generate generates a passphrase from the wordlist, along with
+// its entropy in bits. The entropy is a lower bound, since it
+// doesn't include the positions of the digits.
+func Generate(wordlist []string, opts Options) (string, float64, error) {
+	if opts.Words == 0 {
+		return "", 0, fmt.Errorf("Passphrase must contain at least 1 word")
+	}
+
+	parts := make([]string, opts.Words)
+	for i := range parts {
+		n, err := randInt(len(wordlist))
+		if err != nil {
+			return "", 0, err
+		}
+
+		parts[i] = wordlist[n]
+		if opts.Capitalize {
+			r, size := utf8.DecodeRuneInString(parts[i])
+			parts[i] = string(unicode.ToUpper(r)) + parts[i][size:]
+		}
+	}
+
+	for i := uint(0); i < opts.Digits; i++ {
+		digit, err := randInt(10)
+		if err != nil {
+			return "", 0, err
+		}
+		pos, err := randInt(len(parts) + 1)
+		if err != nil {
+			return "", 0, err
+		}
+
+		parts = append(parts, "")
+		copy(parts[pos+1:], parts[pos:])
+		parts[pos] = fmt.Sprint(digit)
+	}
+
+	entropy := float64(opts.Words)*math.Log2(float64(len(wordlist))) +
+		float64(opts.Digits)*math.Log2(10)
+	return strings.Join(parts, opts.Separator), entropy, nil
+}
+
+// randInt returns a uniformly random integer in [0, n).
+func randInt(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
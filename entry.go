@@ -0,0 +1,160 @@
+package warded
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	fieldLine = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9_.-]*): (.*)$`)
+	fieldName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// Field is a named value in an entry, stored as a "name: value" line.
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Entry is the structured content of a passphrase.
+// The first line is the password, which is followed by any number
+// of field lines. Everything after the fields is kept as notes.
+type Entry struct {
+	Password string  `json:"password"`
+	Fields   []Field `json:"fields,omitempty"`
+	Notes    string  `json:"notes,omitempty"`
+
+	// hasNotes is set when the fields are followed by a newline,
+	// so that empty notes are written back as they were read
+	hasNotes bool
+}
+
+// ParseEntry parses the content of a passphrase.
+// Any content can be parsed, and is written back unchanged by Bytes.
+func ParseEntry(content []byte) *Entry {
+	lines := strings.SplitAfter(string(content), "\n")
+	entry := &Entry{
+		Password: strings.TrimSuffix(lines[0], "\n"),
+	}
+
+	rest := lines[1:]
+	for len(rest) > 0 {
+		match := fieldLine.FindStringSubmatch(strings.TrimSuffix(rest[0], "\n"))
+		if match == nil {
+			break
+		}
+		entry.Fields = append(entry.Fields, Field{Name: match[1], Value: match[2]})
+		rest = rest[1:]
+	}
+
+	// the last line doesn't end with a newline,
+	// so the notes start after the line before it
+	entry.hasNotes = strings.HasSuffix(lines[len(lines)-len(rest)-1], "\n")
+	entry.Notes = strings.Join(rest, "")
+	return entry
+}
+
+// Bytes returns the content of the entry.
+func (e Entry) Bytes() []byte {
+	var buf strings.Builder
+	buf.WriteString(e.Password)
+	for _, field := range e.Fields {
+		fmt.Fprintf(&buf, "\n%s: %s", field.Name, field.Value)
+	}
+	if e.hasNotes || e.Notes != "" {
+		buf.WriteString("\n")
+		buf.WriteString(e.Notes)
+	}
+	return []byte(buf.String())
+}
+
+// Field returns the value of the first field with the given name.
+// Field names aren't case sensitive.
+func (e Entry) Field(name string) (string, bool) {
+	for _, field := range e.Fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetField replaces the value of the first field with the given name,
+// or adds the field after any existing fields.
+func (e *Entry) SetField(name, value string) error {
+	if !fieldName.MatchString(name) {
+		return fmt.Errorf("Invalid field name %q", name)
+	}
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("Value of field %s can't contain a newline", name)
+	}
+
+	for i, field := range e.Fields {
+		if strings.EqualFold(field.Name, name) {
+			e.Fields[i].Value = value
+			return nil
+		}
+	}
+	e.Fields = append(e.Fields, Field{Name: name, Value: value})
+	return nil
+}
+
+// UnsetField removes every field with the given name,
+// returning false if there weren't any.
+func (e *Entry) UnsetField(name string) bool {
+	fields := e.Fields[:0]
+	for _, field := range e.Fields {
+		if !strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		}
+	}
+	removed := len(fields) != len(e.Fields)
+	e.Fields = fields
+	return removed
+}
+
+// GetEntry returns the decrypted passphrase as an Entry.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) GetEntry(passName Name) (*Entry, error) {
+	content, err := w.Get(passName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEntry(content), nil
+}
+
+// SetField sets a field of an existing passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) SetField(passName Name, field, value string) error {
+	return w.editEntry(passName, func(entry *Entry) error {
+		return entry.SetField(field, value)
+	})
+}
+
+// UnsetField removes a field from a passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) UnsetField(passName Name, field string) error {
+	return w.editEntry(passName, func(entry *Entry) error {
+		if !entry.UnsetField(field) {
+			return fmt.Errorf("Field %s doesn't exist in %s", field, passName)
+		}
+		return nil
+	})
+}
+
+func (w Ward) editEntry(passName Name, edit func(entry *Entry) error) error {
+	name, env, err := w.resolve(passName)
+	if err != nil {
+		return err
+	}
+
+	entry := ParseEntry(env.Content)
+	if err = edit(entry); err != nil {
+		return err
+	}
+
+	env.Content = entry.Bytes()
+	env.modified()
+	return w.editEnvelope(name, env)
+}
@@ -0,0 +1,191 @@
+package warded
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Version 2 envelopes contain their own version, which has to match the
+// unauthenticated version of the Passphrase, so that it can't be changed.
+const envelopeVersion = 2
+
+var errVersionMismatch = errors.New("Passphrase version doesn't match its envelope")
+
+// envelope is the encrypted plaintext of a Passphrase.
+// Alias is the name of the passphrase that an alias points to.
+// Previous holds replaced passwords, from the most recent.
+type envelope struct {
+	Version     int          `json:"envelopeVersion,omitempty"`
+	Content     []byte       `json:"content,omitempty"`
+	Alias       string       `json:"alias,omitempty"`
+	Attachments []attachment `json:"attachments,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Previous    []Previous   `json:"previousPasswords,omitempty"`
+	Metadata    Metadata     `json:"metadata"`
+}
+
+// open decrypts the envelope of the passphrase.
+func (pass Passphrase) open(masterKey []byte) (*envelope, error) {
+	plaintext, err := pass.decrypt(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if pass.Version == 0 {
+		// an envelope can't be passed off as the content of a version 0 passphrase
+		var sealed struct {
+			Version int `json:"envelopeVersion"`
+		}
+		if json.Unmarshal(plaintext, &sealed) == nil && sealed.Version > 0 {
+			return nil, errVersionMismatch
+		}
+		return &envelope{Content: plaintext}, nil
+	}
+
+	env := &envelope{}
+	if err = json.Unmarshal(plaintext, env); err != nil {
+		return nil, err
+	}
+	// version 1 envelopes don't contain their version
+	if env.Version != pass.Version && (env.Version != 0 || pass.Version != 1) {
+		return nil, errVersionMismatch
+	}
+	return env, nil
+}
+
+// sealEnvelope encrypts the envelope into a new Passphrase.
+func (w Ward) sealEnvelope(env *envelope) (*Passphrase, error) {
+	env.Version = envelopeVersion
+	plaintext, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := w.newPassphrase(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	pass.Version = envelopeVersion
+	return pass, nil
+}
+
+func (w Ward) readEnvelope(passName Name) (*envelope, error) {
+	p, err := w.path(passName)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := ReadPassphrase(p)
+	if err != nil {
+		return nil, err
+	}
+	return pass.open(w.key)
+}
+
+// editEnvelope encrypts the envelope to the passphrase file,
+// and updates the manifest. The file is put back as it was
+// if the manifest can't be updated.
+func (w Ward) editEnvelope(passName Name, env *envelope) error {
+	pass, err := w.sealEnvelope(env)
+	if err != nil {
+		return err
+	}
+
+	if pass.Filename, err = w.path(passName); err != nil {
+		return err
+	}
+	return w.writeTracked(passName, pass)
+}
+
+// resolve follows any aliases, returning the name and envelope
+// of the first passphrase that isn't an alias.
+// If an alias points to a missing passphrase, the missing name
+// is returned, along with an error satisfying os.IsNotExist.
+func (w Ward) resolve(passName Name) (Name, *envelope, error) {
+	return w.follow(passName, make(map[Name]bool))
+}
+
+func (w Ward) follow(passName Name, seen map[Name]bool) (Name, *envelope, error) {
+	for {
+		if seen[passName] {
+			return passName, nil, fmt.Errorf("Alias cycle found at %s", passName)
+		}
+		seen[passName] = true
+
+		env, err := w.readEnvelope(passName)
+		if err != nil || env.Alias == "" {
+			return passName, env, err
+		}
+
+		// aliases are validated like any other name,
+		// since they're read from the ward
+		next, err := ParseName(env.Alias)
+		if err != nil {
+			return passName, nil, err
+		}
+		passName = next
+	}
+}
+
+// SetAlias makes passName an alias to the target passphrase.
+// The target must exist and must not lead back to passName.
+// An existing passphrase can only be replaced if it's an alias.
+func (w Ward) SetAlias(passName, target Name) error {
+	if env, err := w.readEnvelope(passName); err == nil && env.Alias == "" {
+		return fmt.Errorf("Passphrase %s already exists", passName)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, _, err := w.follow(target, map[Name]bool{passName: true}); err != nil {
+		return err
+	}
+
+	env := newEnvelope()
+	env.Alias = string(target)
+	return w.editEnvelope(passName, env)
+}
+
+// Aliases returns a map from the name of every alias matching
+// the path pattern to the name of the passphrase it points to.
+func (w Ward) Aliases(pathPattern string) (map[Name]Name, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[Name]Name)
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		if env.Alias == "" {
+			continue
+		}
+		if aliases[name], err = ParseName(env.Alias); err != nil {
+			return nil, err
+		}
+	}
+	return aliases, nil
+}
+
+// AliasesTo returns the aliases that point to the given passphrase,
+// or to any passphrase in the given group.
+func (w Ward) AliasesTo(passName Name) ([]Name, error) {
+	aliases, err := w.Aliases("")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []Name
+	for name, target := range aliases {
+		if passName.Contains(target) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,151 @@
+package warded
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// fileMode returns the permissions of files created in the ward.
+func (c WardConfig) fileMode() os.FileMode {
+	if c.GroupRead {
+		return 0640
+	}
+	return 0600
+}
+
+// dirMode returns the permissions of directories created in the ward.
+func (c WardConfig) dirMode() os.FileMode {
+	if c.GroupRead {
+		return 0750
+	}
+	return 0700
+}
+
+// groupID returns the ID of the group that should own the files
+// created in the ward, or -1 if the group shouldn't be changed.
+func (c WardConfig) groupID() (int, error) {
+	if c.Group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(c.Group); err == nil {
+		return gid, nil
+	}
+
+	group, err := user.LookupGroup(c.Group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// setPerms applies the given permissions and the ward's group to a file.
+// The permissions are set explicitly, since they're otherwise masked by the umask.
+func (c WardConfig) setPerms(fileName string, perms os.FileMode) error {
+	gid, err := c.groupID()
+	if err != nil {
+		return err
+	}
+	if gid >= 0 {
+		if err = os.Lchown(fileName, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(fileName, perms)
+}
+
+// mkdirAll creates a directory along with any missing parents,
+// applying the ward's permissions to every directory it creates.
+func (w Ward) mkdirAll(dir string) error {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+		return nil
+	}
+
+	if err := w.mkdirAll(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, w.Config.dirMode()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return w.Config.setPerms(dir, w.Config.dirMode())
+}
+
+// writeFile atomically writes a file in the ward,
+// creating its directory and applying the ward's permissions.
+func (w Ward) writeFile(fileName string, data []byte) error {
+	if err := w.mkdirAll(filepath.Dir(fileName)); err != nil {
+		return err
+	}
+	return w.Config.writeFileAtomic(fileName, data, w.Config.fileMode())
+}
+
+// writeFileAtomic writes data to a temporary file in the same
+// directory as fileName and renames it into place, so that
+// readers never observe a partially written file.
+// The permissions and group are applied before the rename,
+// so they also apply when replacing an existing file.
+func (c WardConfig) writeFileAtomic(fileName string, data []byte, perms os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = c.setPerms(tmp.Name(), perms)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// CheckPermissions returns a warning for every file or directory in the ward
+// that can be accessed by other users, or by its group if GroupRead isn't set.
+// The ward header must only be accessible by its owner.
+// Files that can't be checked, such as unreadable directories,
+// are also reported as warnings.
+func (w Ward) CheckPermissions() ([]string, error) {
+	var warnings []string
+
+	err := filepath.Walk(w.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Can't check the permissions of %s: %s", p, err))
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.Dir, p)
+		if err != nil {
+			return err
+		}
+
+		perms := info.Mode().Perm()
+		switch {
+		case rel == headerName && perms != 0600:
+			warnings = append(warnings, fmt.Sprintf("%s has permissions %#o, instead of 0600", rel, perms))
+		case perms&0007 != 0:
+			warnings = append(warnings, fmt.Sprintf("%s is accessible by other users (%#o)", rel, perms))
+		case perms&0070 != 0 && !w.Config.GroupRead:
+			warnings = append(warnings, fmt.Sprintf("%s is accessible by its group (%#o)", rel, perms))
+		}
+		return nil
+	})
+
+	return warnings, err
+}
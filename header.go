@@ -0,0 +1,154 @@
+package warded
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const headerName = ".warded"
+
+// ErrNoWard is returned when opening a ward that doesn't exist.
+var ErrNoWard = errors.New("Ward doesn't exist")
+
+// Header is stored in the .warded file at the root of a ward.
+// It holds the parameters that are fixed when the ward is initialized,
+// which are the key derivation and cipher used for its passphrases.
+// The rest of the configuration is read from warded.json,
+// so that changes to it apply to existing wards.
+type Header struct {
+	Created       time.Time           `json:"created"`
+	KeyDerivation KeyDerivationConfig `json:"keyDerivation"`
+	Cipher        string              `json:"cipher"`
+}
+
+func newHeader(created time.Time, config WardConfig) Header {
+	return Header{
+		Created:       created,
+		KeyDerivation: config.KeyDerivation,
+		Cipher:        config.Cipher,
+	}
+}
+
+// apply returns the configuration with the parameters fixed by the header.
+func (h Header) apply(config WardConfig) WardConfig {
+	config.KeyDerivation = h.KeyDerivation
+	config.Cipher = h.Cipher
+	return config
+}
+
+// parseHeader parses a ward header. Headers written before the
+// configuration was moved out of them hold the entire configuration,
+// of which only the fixed parameters are kept.
+func parseHeader(data []byte) (*Header, error) {
+	header := struct {
+		Header
+		Config json.RawMessage `json:"config"`
+	}{
+		Header: newHeader(time.Time{}, DefaultWardConfig()),
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	if len(header.Config) > 0 {
+		config := DefaultWardConfig()
+		if err := json.Unmarshal(header.Config, &config); err != nil {
+			return nil, err
+		}
+		header.Header = newHeader(header.Created, config)
+	}
+	return &header.Header, nil
+}
+
+// InitWard creates a new ward in the given directory.
+// The header and an empty manifest are written, so that
+// the master key can be checked before any passphrases are added.
+func InitWard(dir string, config WardConfig, masterKey []byte) (Ward, error) {
+	ward := NewWard()
+	ward.Config = config
+	ward.Dir = dir
+	ward.SetKey(masterKey)
+
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 {
+		return ward, fmt.Errorf("Ward directory %s isn't empty", dir)
+	}
+	if err := ward.mkdirAll(dir); err != nil {
+		return ward, err
+	}
+
+	data, err := json.Marshal(newHeader(time.Now().UTC(), config))
+	if err != nil {
+		return ward, err
+	}
+	if err = ward.Config.writeFileAtomic(filepath.Join(dir, headerName), data, 0600); err != nil {
+		return ward, err
+	}
+
+	return ward, ward.writeManifest(1, make(map[string][]byte))
+}
+
+// OpenWard opens an existing ward in the given directory,
+// using the given configuration along with the key derivation
+// and cipher in the ward header, if it has one.
+// ErrNoWard is returned if the directory doesn't exist,
+// or doesn't contain a ward.
+func OpenWard(dir string, config WardConfig) (Ward, error) {
+	ward := NewWard()
+	ward.Config = config
+	ward.Dir = dir
+
+	if info, err := os.Stat(dir); os.IsNotExist(err) {
+		return ward, ErrNoWard
+	} else if err != nil {
+		return ward, err
+	} else if !info.IsDir() {
+		return ward, fmt.Errorf("Ward %s isn't a directory", dir)
+	}
+
+	// the header is only readable by its owner,
+	// so group members use the given configuration
+	header, err := ward.Header()
+	if err == nil {
+		ward.Config = header.apply(config)
+	} else if os.IsNotExist(err) {
+		// wards created before headers were introduced
+		// are recognized by their manifest or passphrases
+		return ward, ward.checkLegacy()
+	} else if !os.IsPermission(err) {
+		return ward, err
+	}
+	return ward, nil
+}
+
+// checkLegacy returns ErrNoWard if a directory without a header
+// has neither a manifest nor any passphrases.
+func (w Ward) checkLegacy() error {
+	if _, err := os.Stat(filepath.Join(w.Dir, manifestName)); err == nil {
+		return nil
+	}
+
+	passphrases, err := w.List("")
+	if err != nil {
+		return err
+	}
+	if len(passphrases) == 0 {
+		return ErrNoWard
+	}
+	return nil
+}
+
+// Header reads the ward header.
+// Wards created before headers were introduced won't have one,
+// in which case an error satisfying os.IsNotExist is returned.
+func (w Ward) Header() (*Header, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.Dir, headerName))
+	if err != nil {
+		return nil, err
+	}
+	return parseHeader(data)
+}
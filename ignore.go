@@ -0,0 +1,165 @@
+package warded
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+const ignoreName = ".wardedignore"
+
+// A file in a ward is a passphrase unless:
+//   - any element of its name starts with a dot,
+//     since these names are reserved for ward metadata
+//   - it matches an ignore pattern from the ward configuration
+//     or the .wardedignore file at the root of the ward
+//   - it isn't a JSON object containing a cipher and key derivation,
+//     along with a supported version
+// Any other files are foreign files, which are skipped.
+
+// ignoreFilter matches names against ignore patterns.
+// Patterns are matched against slash-separated names relative to the ward,
+// and patterns without a slash are also matched against the base name.
+// Everything in a matched directory is ignored.
+type ignoreFilter []string
+
+// ignoreFilter returns the ignore patterns from the ward configuration
+// and the .wardedignore file.
+func (w Ward) ignoreFilter() (ignoreFilter, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.Dir, ignoreName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return newIgnoreFilter(w.Config.Ignore, data), nil
+}
+
+// newIgnoreFilter combines the patterns with those in the content
+// of a .wardedignore file, which has a pattern on every line.
+// Blank lines and lines starting with # are skipped.
+func newIgnoreFilter(patterns []string, ignoreFile []byte) ignoreFilter {
+	filter := append(ignoreFilter{}, patterns...)
+
+	scanner := bufio.NewScanner(bytes.NewReader(ignoreFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			filter = append(filter, line)
+		}
+	}
+	return filter
+}
+
+// ignored returns true if the slash-separated name, or any
+// of its parent directories, matches an ignore pattern.
+func (f ignoreFilter) ignored(name string) bool {
+	for ; name != "." && name != "/" && name != ""; name = path.Dir(name) {
+		for _, pattern := range f {
+			pattern = strings.TrimSuffix(pattern, "/")
+			if match, _ := doublestar.Match(pattern, name); match {
+				return true
+			}
+			if !strings.Contains(pattern, "/") {
+				if match, _ := doublestar.Match(pattern, path.Base(name)); match {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isPassphrase returns true if the data looks like
+// a passphrase with a supported version.
+func isPassphrase(data []byte) bool {
+	var pass struct {
+		Version       int              `json:"version"`
+		Cipher        *json.RawMessage `json:"cipher"`
+		KeyDerivation *json.RawMessage `json:"keyDerivation"`
+	}
+	if err := json.Unmarshal(data, &pass); err != nil {
+		return false
+	}
+	return pass.Cipher != nil && pass.KeyDerivation != nil &&
+		pass.Version >= 0 && pass.Version <= envelopeVersion
+}
+
+// Foreign returns the names of files matching the path pattern
+// that aren't passphrases, but also aren't ignored or reserved.
+func (w Ward) Foreign(pathPattern string) ([]string, error) {
+	var foreign []string
+	err := w.walkEntries(pathPattern, nil, func(name string) {
+		foreign = append(foreign, name)
+	})
+	return foreign, err
+}
+
+// walkEntries calls fn for every passphrase matching the path pattern.
+// Reserved and ignored files are skipped, while files that aren't
+// passphrases are passed to foreign, unless it's nil.
+// Files with invalid names, or symlinks leading outside of the ward
+// or to directories, are also considered foreign.
+func (w Ward) walkEntries(pathPattern string, fn func(name Name, pass *Passphrase) error, foreign func(name string)) error {
+	filter, err := w.ignoreFilter()
+	if err != nil {
+		return err
+	}
+
+	return w.walkPathPattern(pathPattern, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(w.Dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		skip := func() error {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filter.ignored(filepath.ToSlash(rel)) {
+			return skip()
+		}
+
+		isForeign := func() error {
+			if foreign != nil {
+				foreign(rel)
+			}
+			return skip()
+		}
+
+		name, err := ParseName(filepath.ToSlash(rel))
+		if err != nil || string(name) != filepath.ToSlash(rel) {
+			return isForeign()
+		} else if info.IsDir() {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, err = w.path(name); err != nil {
+				return isForeign()
+			}
+			if target, err := os.Stat(p); err != nil || target.IsDir() {
+				return isForeign()
+			}
+		}
+
+		pass, err := ReadPassphrase(p)
+		if err == ErrNotPassphrase {
+			return isForeign()
+		} else if err != nil || fn == nil {
+			return err
+		}
+		return fn(name, pass)
+	})
+}
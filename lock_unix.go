@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package warded
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPassphrase takes an exclusive lock on a passphrase file,
+// which is held until unlock is called. It serializes changes that
+// read the passphrase before rewriting it, such as advancing an
+// HOTP counter, so that concurrent changes aren't lost.
+// The passphrase must be read again once the lock is held.
+func (w Ward) lockPassphrase(passName Name) (unlock func(), err error) {
+	p, err := w.path(passName)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(p)
+}
+
+// lockManifest takes an exclusive lock on the ward directory,
+// which is held until unlock is called. It serializes changes
+// to the manifest, which is read before it's rewritten.
+func (w Ward) lockManifest() (unlock func(), err error) {
+	return lockFile(w.Dir)
+}
+
+// lockFile takes an exclusive lock on a file or directory.
+func lockFile(p string) (unlock func(), err error) {
+	for {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// files are replaced on every change, so the lock only
+		// holds if the file wasn't replaced while waiting for it
+		locked, err := f.Stat()
+		if err == nil {
+			var current os.FileInfo
+			if current, err = os.Stat(p); err == nil && os.SameFile(locked, current) {
+				return func() { f.Close() }, nil
+			}
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
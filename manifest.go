@@ -0,0 +1,304 @@
+package warded
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const manifestName = ".manifest"
+
+// ErrManifestMAC is returned when the manifest can't be
+// authenticated with the ward's master key.
+var ErrManifestMAC = errors.New("Manifest authentication failed")
+
+// ErrManifestMissing is returned when changing a ward whose manifest
+// has been removed, while ExpectManifest is set.
+// ResetManifest has to be used to accept the contents of the ward.
+var ErrManifestMissing = errors.New("Manifest has been removed")
+
+// Manifest is an authenticated list of every passphrase in a ward.
+// Entries maps a passphrase name to the SHA-256 hash of its file.
+// Version is incremented every time the ward is modified.
+type Manifest struct {
+	Version       uint64              `json:"version"`
+	Entries       map[string][]byte   `json:"entries"`
+	KeyDerivation KeyDerivationConfig `json:"keyDerivation"`
+	MAC           []byte              `json:"mac"`
+}
+
+// ManifestStatus describes the differences between a ward and its manifest.
+type ManifestStatus struct {
+	Version uint64 `json:"version"`
+	// Missing passphrases are in the manifest, but not the ward.
+	Missing []string `json:"missing"`
+	// Unexpected passphrases are in the ward, but not the manifest.
+	Unexpected []string `json:"unexpected"`
+	// Modified passphrases don't match the hash in the manifest.
+	// This happens when a passphrase is replaced by another ciphertext.
+	Modified []string `json:"modified"`
+	// RolledBackFrom is the newer version that was previously seen,
+	// if the manifest has been rolled back to an older version.
+	RolledBackFrom uint64 `json:"rolledBackFrom,omitempty"`
+}
+
+// OK returns true if the ward matches its manifest.
+func (s ManifestStatus) OK() bool {
+	return len(s.Missing) == 0 && len(s.Unexpected) == 0 && len(s.Modified) == 0 &&
+		s.RolledBackFrom == 0
+}
+
+// CheckRollback records a rollback if the manifest is older
+// than the last version that was seen.
+func (s *ManifestStatus) CheckRollback(lastVersion uint64) {
+	if s.Version < lastVersion {
+		s.RolledBackFrom = lastVersion
+	}
+}
+
+// sum returns the MAC of the manifest version and entries.
+func (m Manifest) sum(masterKey []byte) ([]byte, error) {
+	key, err := m.KeyDerivation.Data.newKeyFn(masterKey)(sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(struct {
+		Version uint64            `json:"version"`
+		Entries map[string][]byte `json:"entries"`
+	}{m.Version, m.Entries})
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// Manifest reads the ward's manifest and authenticates it
+// with the ward's master key.
+// If the ward doesn't have a manifest, an error satisfying
+// os.IsNotExist is returned.
+func (w Ward) Manifest() (*Manifest, error) {
+	m, err := w.readManifest()
+	if err == nil {
+		err = m.authenticate(w.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m Manifest) authenticate(masterKey []byte) error {
+	sum, err := m.sum(masterKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum, m.MAC) {
+		return ErrManifestMAC
+	}
+	return nil
+}
+
+// Verify compares the passphrases in the ward against the manifest.
+func (w Ward) Verify() (*ManifestStatus, error) {
+	m, err := w.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := w.hashEntries()
+	if err != nil {
+		return nil, err
+	}
+	return m.compare(entries), nil
+}
+
+// compare returns the differences between the manifest and
+// the given hashes of passphrase files.
+func (m Manifest) compare(entries map[string][]byte) *ManifestStatus {
+	status := &ManifestStatus{Version: m.Version}
+	for name, hash := range entries {
+		if expected, ok := m.Entries[name]; !ok {
+			status.Unexpected = append(status.Unexpected, name)
+		} else if !hmac.Equal(expected, hash) {
+			status.Modified = append(status.Modified, name)
+		}
+	}
+	for name := range m.Entries {
+		if _, ok := entries[name]; !ok {
+			status.Missing = append(status.Missing, name)
+		}
+	}
+
+	sort.Strings(status.Missing)
+	sort.Strings(status.Unexpected)
+	sort.Strings(status.Modified)
+	return status
+}
+
+// ResetManifest replaces the manifest with one that
+// matches the current contents of the ward.
+// This should only be used once the differences reported
+// by Verify are known to be legitimate.
+func (w Ward) ResetManifest() error {
+	unlock, err := w.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := w.hashEntries()
+	if err != nil {
+		return err
+	}
+
+	var version uint64
+	if m, err := w.readManifest(); err == nil {
+		version = m.Version
+	}
+	return w.writeManifest(version+1, entries)
+}
+
+func (w Ward) readManifest() (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.Dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (*Manifest, error) {
+	m := &Manifest{
+		KeyDerivation: KeyDerivationConfig{
+			Type: TypeScrypt,
+			Data: keyDerivationTypeHandlers[TypeScrypt](),
+		},
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.Entries == nil {
+		m.Entries = make(map[string][]byte)
+	}
+	return m, nil
+}
+
+func (w Ward) writeManifest(version uint64, entries map[string][]byte) error {
+	m := Manifest{
+		Version:       version,
+		Entries:       entries,
+		KeyDerivation: w.Config.KeyDerivation,
+	}
+
+	var err error
+	if err = m.KeyDerivation.Data.newSalt(); err != nil {
+		return err
+	}
+	if m.MAC, err = m.sum(w.key); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return w.writeFile(filepath.Join(w.Dir, manifestName), data)
+}
+
+// updateManifest authenticates the manifest, applies the given changes
+// and writes it back with an incremented version.
+// A ward without a manifest will have one created from its current contents,
+// unless ExpectManifest is set.
+// The manifest lock must be held, across any changes to the files it records.
+func (w Ward) updateManifest(update func(entries map[string][]byte) error) error {
+	m, err := w.Manifest()
+	if os.IsNotExist(err) && w.ExpectManifest {
+		return ErrManifestMissing
+	} else if os.IsNotExist(err) {
+		m = &Manifest{}
+		m.Entries, err = w.hashEntries()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = update(m.Entries); err != nil {
+		return err
+	}
+	return w.writeManifest(m.Version+1, m.Entries)
+}
+
+// writeTracked writes a passphrase file and records its hash in the manifest.
+// If the manifest can't be updated, the previous file is put back,
+// so that the ward still matches its manifest.
+func (w Ward) writeTracked(passName Name, pass *Passphrase) error {
+	unlock, err := w.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := ioutil.ReadFile(pass.Filename)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err = w.writePassphrase(pass); err != nil {
+		return err
+	}
+
+	err = w.updateManifest(func(entries map[string][]byte) error {
+		return w.hashEntry(entries, passName)
+	})
+	if err != nil {
+		if existed {
+			w.writeFile(pass.Filename, old)
+		} else {
+			os.Remove(pass.Filename)
+		}
+	}
+	return err
+}
+
+// hashEntry records the current hash of a passphrase in the manifest entries.
+func (w Ward) hashEntry(entries map[string][]byte, passName Name) error {
+	hash, err := hashFile(w.Path(passName))
+	if err == nil {
+		entries[string(passName)] = hash
+	}
+	return err
+}
+
+// hashEntries returns the hash of every passphrase in the ward.
+func (w Ward) hashEntries() (map[string][]byte, error) {
+	passphrases, err := w.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string][]byte, len(passphrases))
+	for _, name := range passphrases {
+		if entries[string(name)], err = hashFile(w.Path(name)); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func hashFile(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
@@ -0,0 +1,123 @@
+package warded
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maskClasses are the hashcat-style placeholders of the mask mode.
+// ?s uses the special characters of the policy, and ?? is a literal ?.
+var maskClasses = map[rune]string{
+	'l': lowerChars,
+	'u': upperChars,
+	'd': digitChars,
+	'h': "0123456789abcdef",
+	'H': "0123456789ABCDEF",
+}
+
+// maskPart is either a literal character,
+// or a placeholder for one of the given characters.
+type maskPart struct {
+	literal rune
+	chars   []rune
+}
+
+// parseMask parses the mask of the policy, such as ?u?l?l?d?d-?s.
+// Excluded characters are removed from the placeholders.
+func (p Policy) parseMask() ([]maskPart, error) {
+	if p.Mask == "" {
+		return nil, fmt.Errorf("Generation policy has no mask")
+	}
+
+	special := specialChars
+	if p.Special != nil {
+		special = *p.Special
+	}
+	exclude := p.Exclude
+	if p.NoAmbiguous {
+		exclude += ambiguousChars
+	}
+
+	var parts []maskPart
+	mask := []rune(p.Mask)
+	for i := 0; i < len(mask); i++ {
+		if mask[i] != '?' {
+			parts = append(parts, maskPart{literal: mask[i]})
+			continue
+		}
+		if i++; i == len(mask) {
+			return nil, fmt.Errorf("Mask %s ends with ?", p.Mask)
+		}
+
+		var chars string
+		switch placeholder := mask[i]; placeholder {
+		case '?':
+			parts = append(parts, maskPart{literal: '?'})
+			continue
+		case 's':
+			chars = special
+		case 'a':
+			chars = lowerChars + upperChars + digitChars + special
+		default:
+			var ok bool
+			if chars, ok = maskClasses[placeholder]; !ok {
+				return nil, fmt.Errorf("Unknown mask placeholder ?%c", placeholder)
+			}
+		}
+
+		part := maskPart{chars: []rune(strings.Map(func(r rune) rune {
+			if strings.ContainsRune(exclude, r) {
+				return -1
+			}
+			return r
+		}, chars))}
+		part.chars = uniqRunes(part.chars)
+		if len(part.chars) == 0 {
+			return nil, fmt.Errorf("Generation policy excludes every character of ?%c", mask[i])
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// generateMask generates a password matching the mask,
+// with a uniformly random character for every placeholder.
+func (p Policy) generateMask() ([]byte, float64, error) {
+	parts, err := p.parseMask()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	password := make([]rune, len(parts))
+	entropy := 0.0
+	for i, part := range parts {
+		if part.chars == nil {
+			password[i] = part.literal
+			continue
+		}
+
+		n, err := randIndex(len(part.chars))
+		if err != nil {
+			return nil, 0, err
+		}
+		password[i] = part.chars[n]
+		entropy += math.Log2(float64(len(part.chars)))
+	}
+	return []byte(string(password)), entropy, nil
+}
+
+// uniqRunes removes duplicate runes, keeping the first of each.
+func uniqRunes(str []rune) []rune {
+	seen := make(map[rune]struct{}, len(str))
+	c := 0
+	for _, v := range str {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		str[c] = v
+		c++
+	}
+	return str[:c]
+}
@@ -0,0 +1,60 @@
+package warded
+
+import (
+	"time"
+)
+
+// Metadata is stored in the encrypted envelope of every passphrase,
+// so that it's authenticated along with the content, and survives
+// copying, moving and rekeying the passphrase.
+// Times are zero if they aren't known, such as for passphrases
+// written before metadata was introduced.
+type Metadata struct {
+	// Created is when the passphrase was first written.
+	Created time.Time `json:"created"`
+	// Modified is when the content of the passphrase last changed.
+	Modified time.Time `json:"modified"`
+	// Rotated is when the password was last replaced by Update.
+	Rotated time.Time `json:"rotated"`
+}
+
+// newEnvelope returns an empty envelope for a new passphrase.
+func newEnvelope() *envelope {
+	now := time.Now().UTC()
+	return &envelope{
+		Metadata: Metadata{Created: now, Modified: now},
+	}
+}
+
+// modified records a change to the content of the envelope.
+func (env *envelope) modified() {
+	env.Metadata.Modified = time.Now().UTC()
+}
+
+// Metadata returns the metadata of a passphrase.
+// Aliases aren't followed, so the metadata of an alias is its own.
+func (w Ward) Metadata(passName Name) (*Metadata, error) {
+	env, err := w.readEnvelope(passName)
+	if err != nil {
+		return nil, err
+	}
+	return &env.Metadata, nil
+}
+
+// MetadataMap returns the metadata of every passphrase matching the path pattern.
+func (w Ward) MetadataMap(pathPattern string) (map[Name]Metadata, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[Name]Metadata, len(passphrases))
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		metadata[name] = env.Metadata
+	}
+	return metadata, nil
+}
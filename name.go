@@ -0,0 +1,101 @@
+package warded
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Name is a validated passphrase name.
+// Names are slash-separated, relative to the ward directory
+// and normalized to NFC, so that names which look the same
+// always refer to the same passphrase.
+type Name string
+
+// ParseName validates and normalizes a passphrase name.
+// Trailing slashes are removed, while empty elements, control
+// characters and elements starting with a dot are rejected,
+// since these would escape the ward or refer to reserved files.
+func ParseName(s string) (Name, error) {
+	name := strings.TrimRight(norm.NFC.String(filepath.ToSlash(s)), "/")
+	if name == "" {
+		return "", fmt.Errorf("Passphrase name %q is empty", s)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("Passphrase name %q contains control characters", s)
+		}
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		switch {
+		case elem == "":
+			return "", fmt.Errorf("Passphrase name %q must be relative, without empty elements", s)
+		case elem == "." || elem == "..":
+			return "", fmt.Errorf("Passphrase name %q escapes the ward", s)
+		case strings.HasPrefix(elem, "."):
+			return "", fmt.Errorf("Passphrase name %q is reserved, since %s starts with a dot", s, elem)
+		}
+	}
+	return Name(name), nil
+}
+
+// Set parses the name, so that it can be used as a command line value.
+func (n *Name) Set(s string) error {
+	name, err := ParseName(s)
+	if err == nil {
+		*n = name
+	}
+	return err
+}
+
+func (n Name) String() string {
+	return string(n)
+}
+
+// Contains returns true if the name is the given name,
+// or a passphrase in the group with that name.
+func (n Name) Contains(other Name) bool {
+	return other == n || strings.HasPrefix(string(other), string(n)+"/")
+}
+
+// path returns the path to the passphrase, making sure that any
+// symlinks along the way don't lead outside of the ward directory.
+// The passphrase itself doesn't need to exist.
+func (w Ward) path(name Name) (string, error) {
+	root, err := filepath.EvalSymlinks(w.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	p := w.Dir
+	for _, elem := range strings.Split(string(name), "/") {
+		p = filepath.Join(p, elem)
+
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		} else if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := filepath.EvalSymlinks(p)
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("Passphrase %s has a dangling symlink at %s", name, p)
+		} else if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(root, target); err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("Passphrase %s links outside of the ward", name)
+		}
+	}
+	return w.Path(name), nil
+}
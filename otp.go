@@ -0,0 +1,113 @@
+package warded
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hexid/warded/otp"
+)
+
+// otpField is the entry field holding an otpauth:// URI.
+const otpField = "otpauth"
+
+// OTP returns the current one-time password of the otpauth field
+// of a passphrase, along with its key.
+// For HOTP, the entry is rewritten with the next counter,
+// unless peek is set, in which case the ward isn't changed.
+// The passphrase is locked while the counter is advanced,
+// so that concurrent calls never return the same password.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) OTP(passName Name, peek bool) (string, *otp.Key, error) {
+	name, env, entry, key, err := w.otpKey(passName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if key.Type == otp.TypeHOTP && !peek {
+		var unlock func()
+		if unlock, err = w.lockPassphrase(name); err != nil {
+			return "", nil, err
+		}
+		defer unlock()
+
+		// the counter may have been advanced before the lock was taken
+		if name, env, entry, key, err = w.otpKey(name); err != nil {
+			return "", nil, err
+		}
+	}
+
+	code, err := key.Code(time.Now())
+	if err != nil || key.Type != otp.TypeHOTP || peek {
+		return code, key, err
+	}
+
+	if err = w.setOTPCounter(name, env, entry, key.Counter+1); err != nil {
+		return "", nil, err
+	}
+	key.Counter++
+	return code, key, nil
+}
+
+// ResyncOTP finds the HOTP counter that generated the given password,
+// searching up to window counters ahead of the counter in the entry,
+// and saves the counter after it.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) ResyncOTP(passName Name, code string, window uint64) (*otp.Key, error) {
+	name, _, err := w.resolve(passName)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := w.lockPassphrase(name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	name, env, entry, key, err := w.otpKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	counter, err := key.Resync(code, window)
+	if err == nil {
+		err = w.setOTPCounter(name, env, entry, counter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.Counter = counter
+	return key, nil
+}
+
+func (w Ward) otpKey(passName Name) (Name, *envelope, *Entry, *otp.Key, error) {
+	name, env, err := w.resolve(passName)
+	if err != nil {
+		return name, nil, nil, nil, err
+	}
+
+	entry := ParseEntry(env.Content)
+	uri, ok := entry.Field(otpField)
+	if !ok {
+		return name, nil, nil, nil, fmt.Errorf("Passphrase %s doesn't have an %s field", passName, otpField)
+	}
+
+	key, err := otp.Parse(uri)
+	return name, env, entry, key, err
+}
+
+// setOTPCounter rewrites the otpauth field with the given counter.
+// The passphrase file is replaced atomically, so the counter
+// is never lost by an interrupted write.
+func (w Ward) setOTPCounter(name Name, env *envelope, entry *Entry, counter uint64) error {
+	uri, _ := entry.Field(otpField)
+	uri, err := otp.SetCounter(uri, counter)
+	if err == nil {
+		err = entry.SetField(otpField, uri)
+	}
+	if err != nil {
+		return err
+	}
+
+	env.Content = entry.Bytes()
+	return w.editEnvelope(name, env)
+}
@@ -0,0 +1,267 @@
+// Package otp implements HOTP (RFC 4226) and TOTP (RFC 6238)
+// one-time passwords, along with the otpauth:// URIs used
+// to share their keys.
+package otp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of one-time passwords.
+const (
+	TypeHOTP = "hotp"
+	TypeTOTP = "totp"
+)
+
+// Defaults used when a URI doesn't specify a parameter.
+const (
+	DefaultAlgorithm = "SHA1"
+	DefaultDigits    = 6
+	DefaultPeriod    = 30 * time.Second
+)
+
+var algorithms = map[string]func() hash.Hash{
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// Key holds everything needed to generate one-time passwords.
+// Counter is only used by HOTP, while Period is only used by TOTP.
+type Key struct {
+	Type      string
+	Issuer    string
+	Account   string
+	Secret    []byte
+	Algorithm string
+	Digits    int
+	Period    time.Duration
+	Counter   uint64
+}
+
+// Parse parses an otpauth:// URI.
+// The issuer can be given as a prefix of the label, or as a parameter,
+// and the secret is base32-encoded, with optional padding.
+func Parse(uri string) (*Key, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("Invalid otpauth URI scheme %s", u.Scheme)
+	}
+
+	key := &Key{
+		Type:      strings.ToLower(u.Host),
+		Algorithm: DefaultAlgorithm,
+		Digits:    DefaultDigits,
+		Period:    DefaultPeriod,
+	}
+	if key.Type != TypeHOTP && key.Type != TypeTOTP {
+		return nil, fmt.Errorf("Unsupported one-time password type %s", u.Host)
+	}
+
+	// the label is either "account" or "issuer:account"
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		key.Issuer = strings.TrimSpace(label[:i])
+		label = label[i+1:]
+	}
+	key.Account = strings.TrimSpace(label)
+
+	params := u.Query()
+	if issuer := params.Get("issuer"); issuer != "" {
+		key.Issuer = issuer
+	}
+
+	secret := strings.ToUpper(strings.Replace(params.Get("secret"), " ", "", -1))
+	if secret == "" {
+		return nil, fmt.Errorf("otpauth URI doesn't contain a secret")
+	}
+	if key.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err != nil {
+		return nil, fmt.Errorf("Invalid otpauth secret: %s", err)
+	}
+
+	if alg := params.Get("algorithm"); alg != "" {
+		key.Algorithm = strings.ToUpper(alg)
+	}
+	if _, ok := algorithms[key.Algorithm]; !ok {
+		return nil, fmt.Errorf("Unsupported otpauth algorithm %s", key.Algorithm)
+	}
+
+	if digits := params.Get("digits"); digits != "" {
+		if key.Digits, err = strconv.Atoi(digits); err != nil || key.Digits < 1 || key.Digits > 10 {
+			return nil, fmt.Errorf("Invalid otpauth digits %s", digits)
+		}
+	}
+
+	if period := params.Get("period"); period != "" {
+		seconds, err := strconv.Atoi(period)
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("Invalid otpauth period %s", period)
+		}
+		key.Period = time.Duration(seconds) * time.Second
+	}
+
+	if counter := params.Get("counter"); counter != "" {
+		if key.Counter, err = strconv.ParseUint(counter, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid otpauth counter %s", counter)
+		}
+	}
+
+	return key, nil
+}
+
+// URI returns the otpauth:// URI of the key.
+func (k Key) URI() string {
+	label := k.Account
+	if k.Issuer != "" {
+		label = k.Issuer + ":" + k.Account
+	}
+
+	params := url.Values{}
+	params.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(k.Secret))
+	if k.Issuer != "" {
+		params.Set("issuer", k.Issuer)
+	}
+	if k.Algorithm != "" && k.Algorithm != DefaultAlgorithm {
+		params.Set("algorithm", k.Algorithm)
+	}
+	if k.Digits != 0 && k.Digits != DefaultDigits {
+		params.Set("digits", strconv.Itoa(k.Digits))
+	}
+	if k.Type == TypeHOTP {
+		params.Set("counter", strconv.FormatUint(k.Counter, 10))
+	} else if k.Period != 0 && k.Period != DefaultPeriod {
+		params.Set("period", strconv.Itoa(int(k.Period/time.Second)))
+	}
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     k.Type,
+		Path:     "/" + label,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
+
+// Code returns the password for the given time with TOTP,
+// or for the current counter with HOTP.
+func (k Key) Code(t time.Time) (string, error) {
+	if k.Type == TypeHOTP {
+		return k.HOTP(k.Counter)
+	}
+	return k.HOTP(k.step(t))
+}
+
+// Remaining returns how long the TOTP password for the given time is valid.
+func (k Key) Remaining(t time.Time) time.Duration {
+	period := k.period()
+	return period - time.Duration(t.UnixNano())%period
+}
+
+func (k Key) period() time.Duration {
+	if k.Period <= 0 {
+		return DefaultPeriod
+	}
+	return k.Period
+}
+
+// step returns the TOTP time step containing t.
+func (k Key) step(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(k.period()/time.Second)
+}
+
+// HOTP returns the password for the given counter, as defined by RFC 4226.
+func (k Key) HOTP(counter uint64) (string, error) {
+	alg := k.Algorithm
+	if alg == "" {
+		alg = DefaultAlgorithm
+	}
+	newHash, ok := algorithms[alg]
+	if !ok {
+		return "", fmt.Errorf("Unsupported otpauth algorithm %s", alg)
+	}
+	digits := k.Digits
+	if digits == 0 {
+		digits = DefaultDigits
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(newHash, k.Secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod), nil
+}
+
+// Resync searches the counters from the key's counter up to window
+// counters ahead of it for one that generates the given HOTP password.
+// The counter after the one found is returned, since that's the one
+// the next password should be generated with.
+func (k Key) Resync(code string, window uint64) (uint64, error) {
+	if k.Type != TypeHOTP {
+		return 0, fmt.Errorf("Only HOTP counters can be resynchronized")
+	}
+	// the window is clamped, so that it doesn't wrap around
+	last := k.Counter + window
+	if last < k.Counter || last == math.MaxUint64 {
+		last = math.MaxUint64 - 1
+	}
+	for counter := k.Counter; counter <= last; counter++ {
+		c, err := k.HOTP(counter)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(c), []byte(code)) {
+			return counter + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Password %s wasn't found within %d counters of %d", code, window, k.Counter)
+}
+
+// SetCounter replaces the counter of an otpauth:// URI,
+// keeping the rest of the URI as it was.
+func SetCounter(uri string, counter uint64) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return "", err
+	}
+
+	param := "counter=" + strconv.FormatUint(counter, 10)
+	params := strings.Split(u.RawQuery, "&")
+	found := false
+	for i, p := range params {
+		if strings.HasPrefix(p, "counter=") {
+			params[i] = param
+			found = true
+		}
+	}
+	if !found {
+		params = append(params, param)
+	}
+
+	u.RawQuery = strings.Join(params, "&")
+	return u.String(), nil
+}
@@ -0,0 +1,68 @@
+package otp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 4226, Appendix D
+func TestHOTP(t *testing.T) {
+	key := Key{Type: TypeHOTP, Secret: []byte("12345678901234567890"), Algorithm: "SHA1", Digits: 6}
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range expected {
+		if got, err := key.HOTP(uint64(counter)); err != nil {
+			t.Errorf("counter %d: %s", counter, err)
+		} else if got != code {
+			t.Errorf("counter %d: expected %s, got %s", counter, code, got)
+		}
+	}
+}
+
+// RFC 6238, Appendix B
+func TestTOTP(t *testing.T) {
+	secrets := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	tests := []struct {
+		time      int64
+		algorithm string
+		code      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, test := range tests {
+		key := Key{
+			Type:      TypeTOTP,
+			Secret:    []byte(secrets[test.algorithm]),
+			Algorithm: test.algorithm,
+			Digits:    8,
+			Period:    30 * time.Second,
+		}
+		if got, err := key.Code(time.Unix(test.time, 0)); err != nil {
+			t.Errorf("%s at %d: %s", test.algorithm, test.time, err)
+		} else if got != test.code {
+			t.Errorf("%s at %d: expected %s, got %s", test.algorithm, test.time, test.code, got)
+		}
+	}
+}
@@ -2,13 +2,21 @@ package warded
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-// Passphrase is the encrypted passphrase
+// ErrNotPassphrase is returned when reading a file that isn't a passphrase.
+var ErrNotPassphrase = errors.New("File isn't a passphrase")
+
+// Passphrase is the encrypted passphrase.
+// Version 0 passphrases encrypt only the content,
+// while later versions encrypt an envelope.
+// Whether a passphrase is an alias is only stored in its envelope.
 type Passphrase struct {
+	Version       int                 `json:"version,omitempty"`
 	Cipher        CipherConfig        `json:"cipher"`
 	KeyDerivation KeyDerivationConfig `json:"keyDerivation"`
 	Filename      string              `json:"-"`
@@ -24,15 +32,21 @@ func defaultPassphrase(config WardConfig) *Passphrase {
 // NewPassphrase creates a new encrypted passphrase.
 // A new passphrase should be generated every time the plaintext is changed
 func (w Ward) newPassphrase(plaintext []byte) (*Passphrase, error) {
+	return sealPassphrase(w.Config, w.key, plaintext)
+}
+
+// sealPassphrase encrypts the plaintext with the given key,
+// using the algorithms in the ward configuration.
+func sealPassphrase(config WardConfig, key []byte, plaintext []byte) (*Passphrase, error) {
 	var err error
-	pass := defaultPassphrase(w.Config)
+	pass := defaultPassphrase(config)
 
 	// new salt on every encrypt
 	if err = pass.KeyDerivation.Data.newSalt(); err != nil {
 		return nil, err
 	}
 
-	keyFn := pass.KeyDerivation.Data.newKeyFn(w.key)
+	keyFn := pass.KeyDerivation.Data.newKeyFn(key)
 	if err = pass.Cipher.Data.Seal(plaintext, keyFn); err != nil {
 		return nil, err
 	}
@@ -40,8 +54,9 @@ func (w Ward) newPassphrase(plaintext []byte) (*Passphrase, error) {
 	return pass, nil
 }
 
-// ReadPassphrase reads the given file and returns a Passphrase
-// assuming it contains the necessary data
+// ReadPassphrase reads the given file and returns a Passphrase.
+// ErrNotPassphrase is returned if the file doesn't contain
+// a passphrase with a supported version.
 func ReadPassphrase(fileName string) (*Passphrase, error) {
 	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
@@ -49,7 +64,9 @@ func ReadPassphrase(fileName string) (*Passphrase, error) {
 	}
 
 	pass := defaultPassphrase(DefaultWardConfig())
-	json.Unmarshal(data, pass)
+	if !isPassphrase(data) || json.Unmarshal(data, pass) != nil {
+		return nil, ErrNotPassphrase
+	}
 	pass.Filename = fileName
 
 	return pass, nil
@@ -57,12 +74,25 @@ func ReadPassphrase(fileName string) (*Passphrase, error) {
 
 // Decrypt returns the plaintext passphrase, assuming
 // that the correct master key has been provided.
+// Aliases have no content.
 func (pass Passphrase) Decrypt(masterKey []byte) ([]byte, error) {
+	env, err := pass.open(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return env.Content, nil
+}
+
+// decrypt returns the plaintext, without parsing the envelope.
+func (pass Passphrase) decrypt(masterKey []byte) ([]byte, error) {
 	keyFn := pass.KeyDerivation.Data.newKeyFn(masterKey)
 	return pass.Cipher.Data.Open(keyFn)
 }
 
-// Write writes the Passphrase to a given file with the provided permissions
+// Write atomically writes the Passphrase to its file with the provided
+// permissions, which also apply if the file already exists.
+// Missing directories are created with the same permissions,
+// along with search permission wherever read permission is given.
 func (pass Passphrase) Write(perms os.FileMode) error {
 	data, err := json.Marshal(pass)
 	if err != nil {
@@ -70,9 +100,20 @@ func (pass Passphrase) Write(perms os.FileMode) error {
 	}
 
 	dir := filepath.Dir(pass.Filename)
-	if err = os.MkdirAll(dir, 0700); err != nil {
+	if err = os.MkdirAll(dir, perms|(perms&0444)>>2); err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(pass.Filename, data, perms)
+	// without a ward, only the permissions are applied
+	return WardConfig{}.writeFileAtomic(pass.Filename, data, perms)
+}
+
+// writePassphrase writes the Passphrase to its file,
+// applying the ward's permissions.
+func (w Ward) writePassphrase(pass *Passphrase) error {
+	data, err := json.Marshal(pass)
+	if err != nil {
+		return err
+	}
+	return w.writeFile(pass.Filename, data)
 }
@@ -0,0 +1,171 @@
+package warded
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/hexid/warded/diceware"
+)
+
+// Generation modes of a Policy.
+const (
+	ModeChars         = "chars"
+	ModeWords         = "words"
+	ModeMask          = "mask"
+	ModePronounceable = "pronounceable"
+)
+
+// Policy is how passwords are generated.
+//
+// In the chars mode, which is the default, Length random characters
+// are generated from lowercase and uppercase letters, digits and
+// special characters. Special is the set of special characters,
+// which defaults to all ASCII punctuation. Each class of characters
+// can have a minimum count, and characters can be excluded, either
+// explicitly, or because they look alike, such as O and 0.
+// NoRepeat prevents any character from being used more than once.
+//
+// In the words mode, Words words are chosen from Wordlist, which is
+// a file with one word on every line, or the EFF large wordlist if
+// it's empty. The words are joined by Separator, which defaults to
+// a space, and can be capitalized or have random digits inserted.
+//
+// In the mask mode, passwords match Mask, which has hashcat-style
+// placeholders: ?l, ?u, ?d, ?s and ?a for lowercase and uppercase
+// letters, digits, special characters and all of them, ?h and ?H
+// for hexadecimal digits, and ?? for a question mark. Every other
+// character is used as is. Excluded characters are never used.
+//
+// In the pronounceable mode, Syllables random syllables are joined
+// by Separator, which defaults to none.
+type Policy struct {
+	Mode    string  `json:"mode,omitempty"`
+	Length  uint    `json:"length,omitempty"`
+	Special *string `json:"special,omitempty"`
+
+	MinLower    uint   `json:"minLower,omitempty"`
+	MinUpper    uint   `json:"minUpper,omitempty"`
+	MinDigits   uint   `json:"minDigits,omitempty"`
+	MinSpecial  uint   `json:"minSpecial,omitempty"`
+	Exclude     string `json:"exclude,omitempty"`
+	NoAmbiguous bool   `json:"noAmbiguous,omitempty"`
+	NoRepeat    bool   `json:"noRepeat,omitempty"`
+
+	Words      uint    `json:"words,omitempty"`
+	Wordlist   string  `json:"wordlist,omitempty"`
+	Separator  *string `json:"separator,omitempty"`
+	Capitalize bool    `json:"capitalize,omitempty"`
+	Digits     uint    `json:"digits,omitempty"`
+
+	Mask      string `json:"mask,omitempty"`
+	Syllables uint   `json:"syllables,omitempty"`
+}
+
+// DefaultPolicy is the policy used when none is configured.
+var DefaultPolicy = Policy{Mode: ModeChars, Length: 24}
+
+// DefaultWords is the number of words generated in the words mode,
+// if it isn't set.
+const DefaultWords = 6
+
+// Validate checks that the policy can generate a password.
+func (p Policy) Validate() error {
+	switch p.Mode {
+	case "", ModeChars:
+		if p.Length == 0 {
+			return fmt.Errorf("Generation policy has no length")
+		}
+		_, err := p.classes()
+		return err
+	case ModeMask:
+		_, err := p.parseMask()
+		return err
+	case ModeWords, ModePronounceable:
+	default:
+		return fmt.Errorf("Unknown generation mode %s", p.Mode)
+	}
+	return nil
+}
+
+// Generate generates a password with the policy,
+// along with its entropy in bits.
+func (p Policy) Generate() ([]byte, float64, error) {
+	if err := p.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	switch p.Mode {
+	case ModeWords:
+		return p.generateWords()
+	case ModeMask:
+		return p.generateMask()
+	case ModePronounceable:
+		return p.generatePronounceable()
+	}
+	return p.generateChars()
+}
+
+func (p Policy) generateWords() ([]byte, float64, error) {
+	wordlist := diceware.EFFLarge()
+	if p.Wordlist != "" {
+		in, err := os.Open(p.Wordlist)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer in.Close()
+
+		if wordlist, err = diceware.ReadWordlist(in); err != nil {
+			return nil, 0, fmt.Errorf("%s: %s", p.Wordlist, err)
+		}
+	}
+
+	opts := diceware.Options{
+		Words:      p.Words,
+		Separator:  " ",
+		Capitalize: p.Capitalize,
+		Digits:     p.Digits,
+	}
+	if opts.Words == 0 {
+		opts.Words = DefaultWords
+	}
+	if p.Separator != nil {
+		opts.Separator = *p.Separator
+	}
+
+	pass, entropy, err := diceware.Generate(wordlist, opts)
+	return []byte(pass), entropy, err
+}
+
+// GeneratePolicy returns the ward's default generation policy.
+func (c WardConfig) GeneratePolicy() Policy {
+	if c.Generate != nil {
+		return *c.Generate
+	}
+	return DefaultPolicy
+}
+
+// Profile returns the named generation profile.
+func (c WardConfig) Profile(name string) (Policy, error) {
+	if policy, ok := c.Profiles[name]; ok {
+		return policy, nil
+	}
+	return Policy{}, fmt.Errorf("Unknown generation profile %s", name)
+}
+
+// PolicyFor returns the generation policy of a passphrase.
+// The profile of the longest group pattern matching the name is used,
+// such as banking/*, or the ward's default policy if none match.
+func (c WardConfig) PolicyFor(passName Name) (Policy, error) {
+	best, profile := "", ""
+	for pattern, name := range c.GroupProfiles {
+		if match, _ := doublestar.Match(pattern, string(passName)); match && len(pattern) > len(best) {
+			best, profile = pattern, name
+		}
+	}
+
+	if profile == "" {
+		return c.GeneratePolicy(), nil
+	}
+	return c.Profile(profile)
+}
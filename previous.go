@@ -0,0 +1,46 @@
+package warded
+
+import (
+	"fmt"
+	"time"
+)
+
+// Previous is a password that was replaced by Update.
+type Previous struct {
+	Password string    `json:"password"`
+	Replaced time.Time `json:"replaced"`
+}
+
+// keepPrevious records the replaced password, keeping at most
+// keep previous passwords. The envelope must already be modified.
+func (env *envelope) keepPrevious(password string, keep int) {
+	previous := Previous{Password: password, Replaced: env.Metadata.Modified}
+	env.Previous = append([]Previous{previous}, env.Previous...)
+	if len(env.Previous) > keep {
+		env.Previous = env.Previous[:keep]
+	}
+}
+
+// PreviousPasswords returns the previous passwords of a passphrase,
+// from the most recently replaced.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) PreviousPasswords(passName Name) ([]Previous, error) {
+	_, env, err := w.resolve(passName)
+	if err != nil {
+		return nil, err
+	}
+	return env.Previous, nil
+}
+
+// PreviousPassword returns the nth previous password of a passphrase,
+// where 1 is the password replaced most recently.
+func (w Ward) PreviousPassword(passName Name, n int) (*Previous, error) {
+	previous, err := w.PreviousPasswords(passName)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(previous) {
+		return nil, fmt.Errorf("Passphrase %s has %d previous passwords", passName, len(previous))
+	}
+	return &previous[n-1], nil
+}
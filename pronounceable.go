@@ -0,0 +1,54 @@
+package warded
+
+import (
+	"math"
+	"strings"
+)
+
+// Syllables of the pronounceable mode are a consonant and a vowel,
+// optionally followed by another consonant. A consonant followed by
+// a vowel always starts a syllable, so every password can only be
+// made of one sequence of syllables, and the entropy isn't overstated.
+const (
+	onsetChars = "bdfghjklmnprstvwz"
+	vowelChars = "aeiou"
+	codaChars  = "bdgklmnprstx"
+)
+
+// DefaultSyllables is the number of syllables generated
+// in the pronounceable mode, if it isn't set.
+const DefaultSyllables = 6
+
+// syllables is the number of distinct syllables.
+const syllables = len(onsetChars) * len(vowelChars) * (len(codaChars) + 1)
+
+// generatePronounceable generates a password of random syllables,
+// joined by the separator, which defaults to none.
+func (p Policy) generatePronounceable() ([]byte, float64, error) {
+	count := p.Syllables
+	if count == 0 {
+		count = DefaultSyllables
+	}
+	separator := ""
+	if p.Separator != nil {
+		separator = *p.Separator
+	}
+
+	parts := make([]string, count)
+	for i := range parts {
+		n, err := randIndex(syllables)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		onset, n := n%len(onsetChars), n/len(onsetChars)
+		vowel, coda := n%len(vowelChars), n/len(vowelChars)
+		parts[i] = string(onsetChars[onset]) + string(vowelChars[vowel])
+		if coda > 0 {
+			parts[i] += string(codaChars[coda-1])
+		}
+	}
+
+	entropy := float64(count) * math.Log2(float64(syllables))
+	return []byte(strings.Join(parts, separator)), entropy, nil
+}
@@ -0,0 +1,138 @@
+package warded
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// refPattern matches references to a field of another passphrase,
+// such as {{ref:infra/db:password}}. The field is everything after
+// the last colon, so that names can contain colons.
+var refPattern = regexp.MustCompile(`\{\{ref:([^{}]+):([A-Za-z0-9][A-Za-z0-9_.-]*)\}\}`)
+
+// Reference is a reference in the content of a passphrase
+// to a field of another passphrase.
+type Reference struct {
+	From  Name   `json:"from"`
+	To    Name   `json:"to"`
+	Field string `json:"field"`
+}
+
+// parseRefs returns the references in the content of a passphrase.
+func parseRefs(from Name, content []byte) ([]Reference, error) {
+	var refs []Reference
+	for _, match := range refPattern.FindAllSubmatch(content, -1) {
+		to, err := ParseName(string(match[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reference in %s: %s", from, err)
+		}
+		refs = append(refs, Reference{From: from, To: to, Field: string(match[2])})
+	}
+	return refs, nil
+}
+
+// Resolve returns the decrypted passphrase content, with every
+// reference replaced by the value of the field it refers to.
+// A reference to the password field is replaced by the first line.
+// Aliases are followed, both for the passphrase and its references.
+func (w Ward) Resolve(passName Name) ([]byte, error) {
+	name, env, err := w.resolve(passName)
+	if err != nil {
+		return nil, err
+	}
+	return w.resolveRefs(name, env.Content, map[Name]bool{name: true})
+}
+
+// resolveRefs replaces the references in the content.
+// The passphrases being resolved are kept in seen to detect cycles.
+func (w Ward) resolveRefs(passName Name, content []byte, seen map[Name]bool) ([]byte, error) {
+	var err error
+	resolved := refPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		if err != nil {
+			return nil
+		}
+
+		var refs []Reference
+		if refs, err = parseRefs(passName, match); err != nil {
+			return nil
+		}
+		ref := refs[0]
+
+		var name Name
+		var env *envelope
+		if name, env, err = w.resolve(ref.To); err != nil {
+			err = fmt.Errorf("Reference in %s to %s: %s", passName, ref.To, err)
+			return nil
+		}
+		if seen[name] {
+			err = fmt.Errorf("Reference cycle found at %s", name)
+			return nil
+		}
+
+		seen[name] = true
+		defer delete(seen, name)
+
+		var target []byte
+		if target, err = w.resolveRefs(name, env.Content, seen); err != nil {
+			return nil
+		}
+
+		entry := ParseEntry(target)
+		if strings.EqualFold(ref.Field, passwordField) {
+			return []byte(entry.Password)
+		}
+		value, ok := entry.Field(ref.Field)
+		if !ok {
+			err = fmt.Errorf("Reference in %s to missing field %s of %s", passName, ref.Field, ref.To)
+		}
+		return []byte(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// Refs returns the references to the given passphrase,
+// or to any passphrase in the given group, from anywhere in the ward.
+// References through aliases are included, since they
+// would also break if it were moved or removed.
+func (w Ward) Refs(passName Name) ([]Reference, error) {
+	passphrases, err := w.Map("")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]Reference, 0)
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		if env.Alias != "" {
+			continue
+		}
+
+		found, err := parseRefs(name, env.Content)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range found {
+			if passName.Contains(ref.To) {
+				refs = append(refs, ref)
+			} else if to, _, err := w.resolve(ref.To); err == nil && passName.Contains(to) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	sort.SliceStable(refs, func(i, j int) bool {
+		if refs[i].From != refs[j].From {
+			return refs[i].From < refs[j].From
+		}
+		return refs[i].To < refs[j].To
+	})
+	return refs, nil
+}
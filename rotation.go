@@ -0,0 +1,146 @@
+package warded
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry fields that set when a passphrase has to be rotated.
+// expires is a date, while rotate-every is an interval
+// counted from when the password was last rotated.
+const (
+	expiresField     = "expires"
+	rotateEveryField = "rotate-every"
+)
+
+// Rotation is a passphrase that is due to be rotated.
+// Error is set instead when it couldn't be checked.
+type Rotation struct {
+	Name    Name      `json:"name"`
+	Due     time.Time `json:"due"`
+	Overdue bool      `json:"overdue"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ParseInterval parses a duration, which can also be given
+// in days or weeks, such as 90d or 2w.
+func ParseInterval(s string) (time.Duration, error) {
+	if n := len(s) - 1; n > 0 && (s[n] == 'd' || s[n] == 'w') {
+		count, err := strconv.Atoi(s[:n])
+		if err != nil {
+			return 0, fmt.Errorf("Invalid interval %s", s)
+		}
+		days := time.Duration(count)
+		if s[n] == 'w' {
+			days *= 7
+		}
+		return days * 24 * time.Hour, nil
+	}
+
+	interval, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid interval %s", s)
+	}
+	return interval, nil
+}
+
+// rotateEvery returns the default rotation interval for the passphrase,
+// from the most specific group in the configuration that contains it.
+// An empty group name sets the default for the entire ward.
+func (c WardConfig) rotateEvery(passName Name) (string, bool) {
+	best, every, found := "", "", false
+	for group, interval := range c.RotateEvery {
+		group = strings.Trim(group, "/")
+		if group != "" && !Name(group).Contains(passName) {
+			continue
+		}
+		if !found || len(group) > len(best) {
+			best, every, found = group, interval, true
+		}
+	}
+	return every, found
+}
+
+// due returns when the passphrase has to be rotated, and false
+// if it doesn't have to be. An expires field takes precedence over
+// a rotate-every field, which takes precedence over the configuration.
+// Passphrases that were never rotated are counted from when they were created.
+func (w Ward) due(passName Name, entry *Entry, meta Metadata) (time.Time, bool, error) {
+	if expires, ok := entry.Field(expiresField); ok {
+		due, err := time.ParseInLocation("2006-01-02", expires, time.Local)
+		if err != nil {
+			return due, false, fmt.Errorf("Invalid %s date %s in %s", expiresField, expires, passName)
+		}
+		return due, true, nil
+	}
+
+	every, ok := entry.Field(rotateEveryField)
+	if !ok {
+		if every, ok = w.Config.rotateEvery(passName); !ok {
+			return time.Time{}, false, nil
+		}
+	}
+	interval, err := ParseInterval(every)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s in %s", err, passName)
+	}
+
+	last := meta.Rotated
+	if last.IsZero() {
+		last = meta.Created
+	}
+	if last.IsZero() {
+		// a passphrase that can't be shown to have been
+		// rotated is always due
+		return last, true, nil
+	}
+	return last.Add(interval), true, nil
+}
+
+// Due returns the passphrases matching the path pattern that have
+// to be rotated before now + within, ordered by when they're due.
+// Aliases are skipped, since they're rotated along with their target.
+// Passphrases that can't be checked are included with their error,
+// so that one of them doesn't hide the others.
+func (w Ward) Due(pathPattern string, within time.Duration, now time.Time) ([]Rotation, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	rotations := make([]Rotation, 0)
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			rotations = append(rotations, Rotation{Name: name, Error: fmt.Sprintf("%s: %s", name, err)})
+			continue
+		}
+		if env.Alias != "" {
+			continue
+		}
+
+		due, ok, err := w.due(name, ParseEntry(env.Content), env.Metadata)
+		if err != nil {
+			rotations = append(rotations, Rotation{Name: name, Error: err.Error()})
+			continue
+		}
+		if ok && due.Before(now.Add(within)) {
+			rotations = append(rotations, Rotation{
+				Name:    name,
+				Due:     due,
+				Overdue: !due.After(now),
+			})
+		}
+	}
+
+	sort.Slice(rotations, func(i, j int) bool {
+		if !rotations[i].Due.Equal(rotations[j].Due) {
+			return rotations[i].Due.Before(rotations[j].Due)
+		}
+		return rotations[i].Name < rotations[j].Name
+	})
+	return rotations, nil
+}
@@ -0,0 +1,493 @@
+package warded
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH keys are passphrases tagged ssh-key, or with a type: ssh-key field,
+// that contain a PEM-encoded private key. The password of the entry is
+// used to decrypt the private key, if it's encrypted.
+// The ssh-confirm and ssh-lifetime fields override the agent's options.
+const (
+	sshKeyType       = "ssh-key"
+	typeField        = "type"
+	sshConfirmField  = "ssh-confirm"
+	sshLifetimeField = "ssh-lifetime"
+)
+
+var errAgentLocked = errors.New("Agent is locked")
+
+// SSHAgentOptions are the defaults for the keys of an SSHAgent.
+// If Confirm is set, every use of a key has to be allowed by ConfirmUse.
+// Keys are removed from the agent after Lifetime, unless it's 0.
+type SSHAgentOptions struct {
+	Confirm    bool
+	Lifetime   time.Duration
+	ConfirmUse func(name Name) bool
+}
+
+// sshKey is a private key served by an SSHAgent.
+// The private key is only kept unencrypted in locked memory,
+// and is parsed again every time it's used.
+// Parsing the key and signing with it makes copies of the key
+// on the Go heap, which can't be locked, so they're wiped as soon
+// as they're no longer needed. The password of an encrypted key
+// is held in a string while it's loaded, which can't be wiped.
+type sshKey struct {
+	name     Name
+	private  Key
+	public   ssh.PublicKey
+	confirm  bool
+	lifetime time.Duration
+	timer    *time.Timer
+}
+
+func (k *sshKey) wipe() {
+	if k.timer != nil {
+		k.timer.Stop()
+	}
+	k.private.Unlock()
+}
+
+// wipePrivateKey overwrites the secret values of a parsed private key.
+func wipePrivateKey(private interface{}) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		wipeInts(append([]*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}, k.Primes...)...)
+		for _, crt := range k.Precomputed.CRTValues {
+			wipeInts(crt.Exp, crt.Coeff, crt.R)
+		}
+	case *ecdsa.PrivateKey:
+		wipeInts(k.D)
+	case *dsa.PrivateKey:
+		wipeInts(k.X)
+	case *ed25519.PrivateKey:
+		wipeBytes(*k)
+	case ed25519.PrivateKey:
+		wipeBytes(k)
+	}
+}
+
+func wipeInts(ints ...*big.Int) {
+	for _, x := range ints {
+		if x == nil {
+			continue
+		}
+		words := x.Bits()
+		for i := range words {
+			words[i] = 0
+		}
+		x.SetInt64(0)
+	}
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// SSHAgent implements the SSH agent protocol for the SSH keys in a ward.
+// The master key isn't kept by the agent. Locking the agent wipes
+// every key, and unlocking it requires the master key to load them again.
+type SSHAgent struct {
+	ward        Ward
+	pathPattern string
+	options     SSHAgentOptions
+
+	mu     sync.Mutex
+	keys   []*sshKey
+	locked bool
+}
+
+// NewSSHAgent returns an agent serving the SSH keys of the passphrases
+// matching the path pattern. The keys are loaded with the ward's key.
+func (w Ward) NewSSHAgent(pathPattern string, options SSHAgentOptions) (*SSHAgent, error) {
+	a := &SSHAgent{
+		ward:        w,
+		pathPattern: pathPattern,
+		options:     options,
+	}
+	a.ward.SetKey(nil)
+
+	if err := a.load(w); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load decrypts the SSH keys in the ward. The caller must hold a.mu,
+// unless the agent hasn't been returned yet.
+func (a *SSHAgent) load(w Ward) error {
+	passphrases, err := w.Map(a.pathPattern)
+	if err != nil {
+		return err
+	}
+
+	var keys []*sshKey
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err == nil && env.Alias == "" {
+			var key *sshKey
+			if key, err = a.loadKey(name, env); key != nil {
+				keys = append(keys, key)
+			}
+		}
+		if env != nil {
+			wipeBytes(env.Content)
+		}
+		if err != nil {
+			for _, key := range keys {
+				key.wipe()
+			}
+			return err
+		}
+	}
+
+	a.keys = keys
+	for _, key := range keys {
+		if key.lifetime > 0 {
+			key.timer = time.AfterFunc(key.lifetime, a.expire(key))
+		}
+	}
+	return nil
+}
+
+// loadKey returns the SSH key of the envelope, or nil
+// if the passphrase isn't an SSH key.
+func (a *SSHAgent) loadKey(name Name, env *envelope) (*sshKey, error) {
+	entry := ParseEntry(env.Content)
+	if kind, _ := entry.Field(typeField); kind != sshKeyType && !hasTag(env.Tags, sshKeyType) {
+		return nil, nil
+	}
+
+	// the decrypted content is locked until it's wiped
+	content := Key(env.Content)
+	if err := content.Lock(); err != nil {
+		return nil, err
+	}
+	defer content.Unlock()
+
+	block := Key(findPrivateKey(env.Content))
+	if block == nil {
+		return nil, fmt.Errorf("Passphrase %s doesn't contain a private key", name)
+	}
+	if err := block.Lock(); err != nil {
+		return nil, err
+	}
+	defer block.Unlock()
+
+	raw, err := ssh.ParseRawPrivateKey(block)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		password := []byte(entry.Password)
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(block, password)
+		wipeBytes(password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Private key of %s: %s", name, err)
+	}
+	defer wipePrivateKey(raw)
+
+	// the key is stored unencrypted, so that it doesn't
+	// have to be decrypted again every time it's used
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	private, err := marshalLocked(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &sshKey{
+		name:    name,
+		private: private,
+		public:  signer.PublicKey(),
+		confirm: a.options.Confirm,
+	}
+
+	if confirm, ok := entry.Field(sshConfirmField); ok {
+		key.confirm = confirm == "yes"
+	}
+	key.lifetime = a.options.Lifetime
+	if value, ok := entry.Field(sshLifetimeField); ok {
+		if key.lifetime, err = ParseInterval(value); err != nil {
+			key.wipe()
+			return nil, fmt.Errorf("%s in %s", err, name)
+		}
+	}
+	return key, nil
+}
+
+// marshalLocked returns the PEM encoding of a private key in locked memory.
+// The intermediate encodings are wiped.
+func marshalLocked(raw interface{}) (Key, error) {
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(block.Bytes)
+
+	encoded := pem.EncodeToMemory(block)
+	defer wipeBytes(encoded)
+
+	private := make(Key, len(encoded))
+	if err = private.Lock(); err != nil {
+		return nil, err
+	}
+	copy(private, encoded)
+	return private, nil
+}
+
+// expire returns a function that removes the key once its lifetime is over.
+func (a *SSHAgent) expire(key *sshKey) func() {
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.remove(func(k *sshKey) bool { return k == key })
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// findPrivateKey returns a copy of the first PEM-encoded private key
+// in the content, which should be wiped once it has been parsed.
+func findPrivateKey(content []byte) []byte {
+	for rest := content; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return nil
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			// the decoded block is a copy of the key as well
+			defer wipeBytes(block.Bytes)
+			return pem.EncodeToMemory(block)
+		}
+		wipeBytes(block.Bytes)
+	}
+}
+
+// remove wipes and removes the keys that match. The caller must hold a.mu.
+func (a *SSHAgent) remove(match func(key *sshKey) bool) bool {
+	found := false
+	keys := a.keys[:0]
+	for _, key := range a.keys {
+		if match(key) {
+			key.wipe()
+			found = true
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	a.keys = keys
+	return found
+}
+
+// Close wipes every key.
+func (a *SSHAgent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.remove(func(*sshKey) bool { return true })
+	return nil
+}
+
+// List returns the keys served by the agent, with the passphrase names
+// as comments. A locked agent has no keys.
+func (a *SSHAgent) List() ([]*agent.Key, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := make([]*agent.Key, 0, len(a.keys))
+	for _, key := range a.keys {
+		keys = append(keys, &agent.Key{
+			Format:  key.public.Type(),
+			Blob:    key.public.Marshal(),
+			Comment: string(key.name),
+		})
+	}
+	return keys, nil
+}
+
+// Sign signs the data with the given key.
+func (a *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs the data with the given key,
+// using the signature algorithm selected by the flags.
+// The agent isn't held while ConfirmUse is waiting for an answer,
+// so the key is only used if it's still loaded once it's allowed.
+func (a *SSHAgent) SignWithFlags(public ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	key, err := a.find(public)
+	if err != nil {
+		return nil, err
+	}
+	if key.confirm && (a.options.ConfirmUse == nil || !a.options.ConfirmUse(key.name)) {
+		return nil, fmt.Errorf("Use of %s wasn't allowed", key.name)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, errAgentLocked
+	}
+	if !a.loaded(key) {
+		return nil, fmt.Errorf("Key %s was removed", key.name)
+	}
+
+	// the parsed key is only needed for this signature
+	raw, err := ssh.ParseRawPrivateKey(key.private)
+	if err != nil {
+		return nil, err
+	}
+	defer wipePrivateKey(raw)
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch flags {
+	case 0:
+		return signer.Sign(rand.Reader, data)
+	case agent.SignatureFlagRsaSha256:
+		return signAlgorithm(signer, data, ssh.KeyAlgoRSASHA256)
+	case agent.SignatureFlagRsaSha512:
+		return signAlgorithm(signer, data, ssh.KeyAlgoRSASHA512)
+	}
+	return nil, fmt.Errorf("Unsupported signature flags %d", flags)
+}
+
+// find returns the loaded key with the given public key.
+func (a *SSHAgent) find(public ssh.PublicKey) (*sshKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return nil, errAgentLocked
+	}
+
+	wanted := public.Marshal()
+	for _, key := range a.keys {
+		if bytes.Equal(key.public.Marshal(), wanted) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("Key not found")
+}
+
+// loaded returns true if the key hasn't been removed. The caller must hold a.mu.
+func (a *SSHAgent) loaded(key *sshKey) bool {
+	for _, k := range a.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func signAlgorithm(signer ssh.Signer, data []byte, algorithm string) (*ssh.Signature, error) {
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("Key doesn't support the %s algorithm", algorithm)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+// Add isn't supported, since keys are loaded from the ward.
+func (a *SSHAgent) Add(key agent.AddedKey) error {
+	return errors.New("Keys can't be added to the agent. Store them in the ward instead")
+}
+
+// Remove wipes and removes a key.
+func (a *SSHAgent) Remove(public ssh.PublicKey) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+
+	wanted := public.Marshal()
+	if !a.remove(func(key *sshKey) bool { return bytes.Equal(key.public.Marshal(), wanted) }) {
+		return errors.New("Key not found")
+	}
+	return nil
+}
+
+// RemoveAll wipes and removes every key.
+func (a *SSHAgent) RemoveAll() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+
+	a.remove(func(*sshKey) bool { return true })
+	return nil
+}
+
+// Lock wipes every key. The passphrase isn't used,
+// since unlocking requires the master key.
+func (a *SSHAgent) Lock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return errAgentLocked
+	}
+
+	a.remove(func(*sshKey) bool { return true })
+	a.locked = true
+	return nil
+}
+
+// Unlock loads the keys from the ward again,
+// using the passphrase as the master key.
+func (a *SSHAgent) Unlock(passphrase []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		return errors.New("Agent isn't locked")
+	}
+
+	w := a.ward
+	w.SetKey(passphrase)
+	if err := w.CheckKey(); err != nil {
+		return err
+	}
+	if err := a.load(w); err != nil {
+		return err
+	}
+	a.locked = false
+	return nil
+}
+
+// Signers isn't supported, since private keys only leave
+// locked memory while signing.
+func (a *SSHAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("Signers aren't supported by the agent")
+}
+
+// Extension isn't supported.
+func (a *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
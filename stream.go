@@ -0,0 +1,186 @@
+package warded
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Streams are encrypted in chunks, so that files of any size can be
+// encrypted and decrypted in constant memory.
+// Each chunk is sealed with chacha20poly1305, using a nonce made of a
+// random prefix, the chunk counter and a flag marking the last chunk.
+// This prevents chunks from being reordered, dropped or truncated.
+const (
+	streamChunkSize  = 64 * 1024
+	streamPrefixSize = chacha20poly1305.NonceSize - 5
+	streamVersion    = 1
+)
+
+var errStreamTruncated = errors.New("Encrypted stream is truncated")
+
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// streamSize returns the size of a stream encrypting size bytes.
+// Every stream ends with a short chunk, which can be empty.
+func streamSize(size int64) int64 {
+	chunks := size/streamChunkSize + 1
+	return 1 + streamPrefixSize + size + chunks*chacha20poly1305.Overhead
+}
+
+type streamWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// newStreamWriter returns a writer that encrypts everything written to it.
+// Close must be called to write the last chunk.
+func newStreamWriter(out io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 1+streamPrefixSize)
+	header[0] = streamVersion
+	if _, err = io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return nil, err
+	}
+	if _, err = out.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		out:    out,
+		aead:   aead,
+		prefix: header[1:],
+		buf:    make([]byte, 0, streamChunkSize),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only written once more data arrives,
+		// since the last chunk has to be marked when closing
+		if len(s.buf) == streamChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(s.buf[len(s.buf):streamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (s *streamWriter) flush(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("Encrypted stream is too long")
+	}
+
+	sealed := s.aead.Seal(nil, streamNonce(s.prefix, s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+
+	_, err := s.out.Write(sealed)
+	return err
+}
+
+func (s *streamWriter) Close() error {
+	// the last chunk must be short, so that it can be recognized
+	if len(s.buf) == streamChunkSize {
+		if err := s.flush(false); err != nil {
+			return err
+		}
+	}
+	return s.flush(true)
+}
+
+type streamReader struct {
+	in      io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+// newStreamReader returns a reader that decrypts a stream
+// written by a stream writer.
+// An error is returned if the stream was modified or truncated.
+func newStreamReader(in io.Reader, key []byte) (io.Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 1+streamPrefixSize)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return nil, errStreamTruncated
+	}
+	if header[0] != streamVersion {
+		return nil, errors.New("Unsupported encrypted stream version")
+	}
+
+	return &streamReader{
+		in:     in,
+		aead:   aead,
+		prefix: header[1:],
+		chunk:  make([]byte, streamChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk.
+// A full chunk is never the last, while a short chunk always is.
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.in, s.chunk)
+	last := err == io.ErrUnexpectedEOF
+	if err == io.EOF {
+		return errStreamTruncated
+	} else if err != nil && !last {
+		return err
+	}
+
+	s.buf, err = s.aead.Open(s.chunk[:0], streamNonce(s.prefix, s.counter, last), s.chunk[:n], nil)
+	if err != nil {
+		return errors.New("Failed to decrypt stream")
+	}
+	s.counter++
+	s.done = last
+	return nil
+}
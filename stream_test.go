@@ -0,0 +1,136 @@
+package warded
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var streamSizes = []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3 * streamChunkSize}
+
+func sealStream(t *testing.T, key, plaintext []byte) []byte {
+	var out bytes.Buffer
+	w, err := newStreamWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd write sizes, so that chunks are split across writes
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func openStream(key, sealed []byte) ([]byte, error) {
+	r, err := newStreamReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := randomBytes(t, chacha20poly1305.KeySize)
+
+	for _, size := range streamSizes {
+		plaintext := randomBytes(t, size)
+		sealed := sealStream(t, key, plaintext)
+
+		if int64(len(sealed)) != streamSize(int64(size)) {
+			t.Errorf("size %d: sealed %d bytes, expected %d", size, len(sealed), streamSize(int64(size)))
+		}
+
+		opened, err := openStream(key, sealed)
+		if err != nil {
+			t.Errorf("size %d: %s", size, err)
+		} else if !bytes.Equal(opened, plaintext) {
+			t.Errorf("size %d: plaintext doesn't match", size)
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	sealed := sealStream(t, randomBytes(t, chacha20poly1305.KeySize), []byte("attachment"))
+	if _, err := openStream(randomBytes(t, chacha20poly1305.KeySize), sealed); err == nil {
+		t.Error("Stream opened with the wrong key")
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := randomBytes(t, chacha20poly1305.KeySize)
+	sealed := sealStream(t, key, randomBytes(t, 2*streamChunkSize+10))
+	header := 1 + streamPrefixSize
+	full := streamChunkSize + chacha20poly1305.Overhead
+
+	for _, i := range []int{0, 1, header, header + full - 1, header + full, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		if _, err := openStream(key, tampered); err == nil {
+			t.Errorf("Stream opened with byte %d modified", i)
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := randomBytes(t, chacha20poly1305.KeySize)
+	header := 1 + streamPrefixSize
+	full := streamChunkSize + chacha20poly1305.Overhead
+
+	// a stream of full chunks still ends with an empty chunk
+	sealed := sealStream(t, key, randomBytes(t, 2*streamChunkSize))
+
+	for _, n := range []int{0, header - 1, header, header + full, header + 2*full, len(sealed) - 1} {
+		if _, err := openStream(key, sealed[:n]); err == nil {
+			t.Errorf("Stream opened when truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	key := randomBytes(t, chacha20poly1305.KeySize)
+	header := 1 + streamPrefixSize
+	full := streamChunkSize + chacha20poly1305.Overhead
+	sealed := sealStream(t, key, randomBytes(t, 2*streamChunkSize+10))
+
+	first := sealed[header : header+full]
+	second := sealed[header+full : header+2*full]
+
+	var reordered []byte
+	reordered = append(reordered, sealed[:header]...)
+	reordered = append(reordered, second...)
+	reordered = append(reordered, first...)
+	reordered = append(reordered, sealed[header+2*full:]...)
+	if _, err := openStream(key, reordered); err == nil {
+		t.Error("Stream opened with reordered chunks")
+	}
+
+	// dropping a full chunk leaves a valid last chunk at the wrong counter
+	var dropped []byte
+	dropped = append(dropped, sealed[:header+full]...)
+	dropped = append(dropped, sealed[header+2*full:]...)
+	if _, err := openStream(key, dropped); err == nil {
+		t.Error("Stream opened with a dropped chunk")
+	}
+}
@@ -0,0 +1,437 @@
+package warded
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// syncDir holds the ID of this copy of the ward, along with a sync base
+// for every copy it has been synced with, named after their IDs.
+// Keeping a base for each copy lets changes spread between any number
+// of copies without being mistaken for conflicts.
+const (
+	syncDir        = ".sync"
+	syncIDName     = "id"
+	syncLegacyName = "legacy"
+	syncIDSize     = 16
+)
+
+// SyncResult lists the passphrases changed by Sync.
+type SyncResult struct {
+	// Pulled passphrases were copied from the other ward.
+	Pulled []Name `json:"pulled"`
+	// Pushed passphrases were copied to the other ward.
+	Pushed []Name `json:"pushed"`
+	// Deleted passphrases were removed from one ward,
+	// so they have been removed from the other.
+	Deleted []Name `json:"deleted"`
+	// Merged passphrases were changed in both wards to the same content,
+	// but with different metadata, which has been combined in both.
+	Merged []Name `json:"merged"`
+	// Conflicts were changed in both wards.
+	// The local version has been kept as "{passName}.conflict-{host}".
+	Conflicts []Name `json:"conflicts"`
+}
+
+// Sync reconciles the ward with another copy of it.
+// Passphrases are compared by their decrypted envelopes, which include
+// both the content and the modification metadata, so that changes to
+// either are synced. Passphrases that have only changed in one ward
+// since the last sync are copied to the other. Passphrases that have
+// changed in both to the same content have their metadata merged,
+// while other changes in both are kept as the other ward's version,
+// along with the local version as a conflict named after the given host.
+// Both wards must use the same master key.
+func (w Ward) Sync(other Ward, host string) (*SyncResult, error) {
+	other.key = w.key
+
+	var err error
+	if err = w.CheckKey(); err == nil {
+		err = other.CheckKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := w.syncID()
+	if err != nil {
+		return nil, err
+	}
+	otherID, err := other.syncID()
+	if err != nil {
+		return nil, err
+	}
+	if id == otherID {
+		// the other ward was copied from this one, so it needs its own ID
+		if otherID, err = other.newSyncID(); err != nil {
+			return nil, err
+		}
+	}
+
+	base, err := w.readSyncBase(otherID)
+	if err != nil {
+		return nil, err
+	}
+	otherBase, err := other.readSyncBase(id)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := w.List("")
+	if err != nil {
+		return nil, err
+	}
+	remote, err := other.List("")
+	if err != nil {
+		return nil, err
+	}
+	names := uniqNames(append(local, remote...))
+
+	result := &SyncResult{}
+	newBase := make(map[string][]byte, len(names))
+
+	for _, name := range names {
+		var a, b []byte
+		if a, err = w.getIfExists(name); err != nil {
+			return nil, err
+		}
+		if b, err = other.getIfExists(name); err != nil {
+			return nil, err
+		}
+
+		// the previous content is only known if both wards agree on it
+		var prev []byte
+		if bytes.Equal(base[string(name)], otherBase[string(name)]) {
+			prev = base[string(name)]
+		}
+		aSum, bSum := contentSum(a), contentSum(b)
+
+		switch {
+		case a != nil && b != nil && bytes.Equal(aSum, bSum):
+			newBase[string(name)] = aSum
+
+		case a != nil && b != nil && bytes.Equal(aSum, prev):
+			if err = w.put(other, name, b); err != nil {
+				return nil, err
+			}
+			result.Pulled = append(result.Pulled, name)
+			newBase[string(name)] = bSum
+
+		case a != nil && b != nil && bytes.Equal(bSum, prev):
+			if err = other.put(w, name, a); err != nil {
+				return nil, err
+			}
+			result.Pushed = append(result.Pushed, name)
+			newBase[string(name)] = aSum
+
+		case a != nil && b != nil && sameContent(a, b):
+			var merged []byte
+			if merged, err = mergeMetadata(a, b); err != nil {
+				return nil, err
+			}
+			if err = w.put(other, name, merged); err == nil {
+				err = other.put(w, name, merged)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Merged = append(result.Merged, name)
+			newBase[string(name)] = contentSum(merged)
+
+		case a != nil && b != nil:
+			var conflict Name
+			var local []byte
+			if conflict, err = ParseName(string(name) + ".conflict-" + host); err != nil {
+				return nil, err
+			}
+			// the attachments of the local version are removed
+			// when it's replaced, so the conflict needs its own
+			if local, err = w.withOwnAttachments(a); err != nil {
+				return nil, err
+			}
+			if err = w.put(w, conflict, local); err == nil {
+				err = other.put(w, conflict, local)
+			}
+			if err == nil {
+				err = w.put(other, name, b)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Conflicts = append(result.Conflicts, name)
+			newBase[string(name)] = bSum
+			newBase[string(conflict)] = contentSum(local)
+
+		case a != nil && bytes.Equal(aSum, prev):
+			if err = w.Remove(name); err != nil {
+				return nil, err
+			}
+			result.Deleted = append(result.Deleted, name)
+
+		case b != nil && bytes.Equal(bSum, prev):
+			if err = other.Remove(name); err != nil {
+				return nil, err
+			}
+			result.Deleted = append(result.Deleted, name)
+
+		case a != nil:
+			if err = other.put(w, name, a); err != nil {
+				return nil, err
+			}
+			result.Pushed = append(result.Pushed, name)
+			newBase[string(name)] = aSum
+
+		case b != nil:
+			if err = w.put(other, name, b); err != nil {
+				return nil, err
+			}
+			result.Pulled = append(result.Pulled, name)
+			newBase[string(name)] = bSum
+		}
+	}
+
+	if err = w.writeSyncBase(otherID, newBase); err == nil {
+		err = other.writeSyncBase(id, newBase)
+	}
+	return result, err
+}
+
+// getIfExists returns the decrypted envelope of the passphrase,
+// encoded as JSON, or nil if the passphrase doesn't exist.
+// Aliases aren't followed, so that they're synced as aliases.
+func (w Ward) getIfExists(passName Name) ([]byte, error) {
+	env, err := w.readEnvelope(passName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// put writes an envelope returned by getIfExists from another ward,
+// copying any attachments that are missing.
+// The attachments of the replaced envelope that aren't kept are removed.
+func (w Ward) put(from Ward, passName Name, data []byte) error {
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return err
+	}
+
+	old, err := w.readEnvelope(passName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = w.copyAttachments(from, env); err != nil {
+		return err
+	}
+	if err = w.editEnvelope(passName, env); err != nil {
+		return err
+	}
+	if old != nil {
+		return w.removeReplacedAttachments(old, env)
+	}
+	return nil
+}
+
+// withOwnAttachments returns an envelope returned by getIfExists,
+// with new copies of its attachment files, so that it can be put
+// under another name without sharing them.
+func (w Ward) withOwnAttachments(data []byte) ([]byte, error) {
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, err
+	}
+	if err := w.duplicateAttachments(env); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// sameContent returns true if the envelopes returned by getIfExists
+// only differ in their metadata.
+func sameContent(a, b []byte) bool {
+	var envA, envB envelope
+	if json.Unmarshal(a, &envA) != nil || json.Unmarshal(b, &envB) != nil {
+		return false
+	}
+	envA.Metadata, envB.Metadata = Metadata{}, Metadata{}
+
+	dataA, errA := json.Marshal(envA)
+	dataB, errB := json.Marshal(envB)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// mergeMetadata returns the envelope a, with the earliest creation time
+// and the latest modification and rotation times of both envelopes.
+func mergeMetadata(a, b []byte) ([]byte, error) {
+	var envA, envB envelope
+	if err := json.Unmarshal(a, &envA); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &envB); err != nil {
+		return nil, err
+	}
+
+	meta, other := &envA.Metadata, envB.Metadata
+	if meta.Created.IsZero() || (!other.Created.IsZero() && other.Created.Before(meta.Created)) {
+		meta.Created = other.Created
+	}
+	if other.Modified.After(meta.Modified) {
+		meta.Modified = other.Modified
+	}
+	if other.Rotated.After(meta.Rotated) {
+		meta.Rotated = other.Rotated
+	}
+	return json.Marshal(envA)
+}
+
+// syncID returns the random ID of this copy of the ward, which
+// names the sync base kept by the wards it has been synced with.
+// The ID is created by the first sync.
+func (w Ward) syncID() (string, error) {
+	if err := w.migrateSyncBase(); err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(w.Dir, syncDir, syncIDName))
+	if os.IsNotExist(err) {
+		return w.newSyncID()
+	} else if err != nil {
+		return "", err
+	}
+
+	// the ID names a file, so it's validated like any other name
+	id := strings.TrimSpace(string(data))
+	if raw, err := hex.DecodeString(id); err != nil || len(raw) != syncIDSize {
+		return "", fmt.Errorf("Invalid sync ID in %s", w.Dir)
+	}
+	return id, nil
+}
+
+// newSyncID replaces the ID of this copy of the ward.
+func (w Ward) newSyncID() (string, error) {
+	raw := make([]byte, syncIDSize)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(raw)
+	return id, w.writeFile(filepath.Join(w.Dir, syncDir, syncIDName), []byte(id))
+}
+
+// migrateSyncBase moves the single sync base of a ward synced before
+// a base was kept for each copy into the sync directory, where it's
+// used for every copy that doesn't have a base of its own yet.
+func (w Ward) migrateSyncBase() error {
+	p := filepath.Join(w.Dir, syncDir)
+	if info, err := os.Stat(p); os.IsNotExist(err) {
+		return nil
+	} else if err != nil || info.IsDir() {
+		return err
+	}
+
+	tmp := filepath.Join(w.Dir, ".tmp-sync")
+	if err := os.Rename(p, tmp); err != nil {
+		return err
+	}
+	if err := w.mkdirAll(p); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(p, syncLegacyName))
+}
+
+// readSyncBase returns the hash of every passphrase's envelope,
+// including its metadata, at the time of the last sync with the
+// copy of the ward with the given ID.
+// The hashes are kept encrypted, since they would reveal
+// which passphrases share the same content.
+func (w Ward) readSyncBase(peer string) (map[string][]byte, error) {
+	base, err := w.readSyncFile(peer)
+	if os.IsNotExist(err) {
+		base, err = w.readSyncFile(syncLegacyName)
+	}
+	if os.IsNotExist(err) {
+		return make(map[string][]byte), nil
+	}
+	return base, err
+}
+
+// readSyncBases returns every sync base of the ward, by file name.
+func (w Ward) readSyncBases() (map[string]map[string][]byte, error) {
+	files, err := ioutil.ReadDir(filepath.Join(w.Dir, syncDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bases := make(map[string]map[string][]byte)
+	for _, file := range files {
+		if name := file.Name(); name != syncIDName && !strings.HasPrefix(name, ".tmp-") {
+			if bases[name], err = w.readSyncFile(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bases, nil
+}
+
+func (w Ward) readSyncFile(name string) (map[string][]byte, error) {
+	pass, err := ReadPassphrase(filepath.Join(w.Dir, syncDir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := pass.Decrypt(w.key)
+	if err != nil {
+		return nil, err
+	}
+	base := make(map[string][]byte)
+	return base, json.Unmarshal(data, &base)
+}
+
+func (w Ward) writeSyncBase(peer string, base map[string][]byte) error {
+	data, err := json.Marshal(base)
+	if err != nil {
+		return err
+	}
+
+	pass, err := w.newPassphrase(data)
+	if err != nil {
+		return err
+	}
+	pass.Filename = filepath.Join(w.Dir, syncDir, peer)
+	return w.writePassphrase(pass)
+}
+
+func contentSum(content []byte) []byte {
+	if content == nil {
+		return nil
+	}
+	sum := sha256.Sum256(content)
+	return sum[:]
+}
+
+func uniqNames(names []Name) []Name {
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	c := 0
+	for i, name := range names {
+		if i > 0 && name == names[c-1] {
+			continue
+		}
+		names[c] = name
+		c++
+	}
+	return names[:c]
+}
@@ -0,0 +1,101 @@
+package warded
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// replicas returns copies of the same ward in separate directories.
+func replicas(t *testing.T, n int) []Ward {
+	first := tempWard(t)
+	wards := []Ward{first}
+	for i := 1; i < n; i++ {
+		w := first
+		w.Config.KeyDerivation.Data = &Scrypt{Iterations: 1024, BlockSize: 8, Parallel: 1}
+		w.Dir = filepath.Join(filepath.Dir(first.Dir), "copy"+strconv.Itoa(i))
+		wards = append(wards, w)
+	}
+	return wards
+}
+
+func mustSync(t *testing.T, w, other Ward) *SyncResult {
+	t.Helper()
+	result, err := w.Sync(other, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSyncThreeReplicasChange(t *testing.T) {
+	wards := replicas(t, 3)
+	laptop, desktop, usb := wards[0], wards[1], wards[2]
+
+	if err := laptop.Edit("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	mustSync(t, laptop, usb)
+	mustSync(t, desktop, usb)
+
+	// a change on the desktop reaches the laptop through the usb copy
+	if err := desktop.Edit("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	mustSync(t, desktop, usb)
+	result := mustSync(t, laptop, usb)
+
+	if !reflect.DeepEqual(result.Pulled, []Name{"a"}) || len(result.Conflicts) != 0 {
+		t.Errorf("Expected a to be pulled, got %+v", result)
+	}
+	if content, err := laptop.Get("a"); err != nil || string(content) != "2" {
+		t.Errorf("Expected the desktop's content, got %q (%v)", content, err)
+	}
+}
+
+func TestSyncThreeReplicasDelete(t *testing.T) {
+	wards := replicas(t, 3)
+	laptop, desktop, usb := wards[0], wards[1], wards[2]
+
+	if err := laptop.Edit("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	mustSync(t, laptop, usb)
+	mustSync(t, desktop, usb)
+
+	// a deletion on the desktop isn't pushed back by the laptop
+	if err := desktop.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	mustSync(t, desktop, usb)
+	result := mustSync(t, laptop, usb)
+
+	if !reflect.DeepEqual(result.Deleted, []Name{"a"}) || len(result.Pushed) != 0 {
+		t.Errorf("Expected a to be deleted, got %+v", result)
+	}
+	for _, w := range wards {
+		if _, err := w.Get("a"); !os.IsNotExist(err) {
+			t.Errorf("Expected a to be deleted from %s, got %v", w.Dir, err)
+		}
+	}
+}
+
+func TestSyncCopiedWard(t *testing.T) {
+	wards := replicas(t, 2)
+	w, other := wards[0], wards[1]
+
+	id, err := w.syncID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.writeFile(filepath.Join(other.Dir, syncDir, syncIDName), []byte(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	mustSync(t, w, other)
+	if otherID, err := other.syncID(); err != nil || otherID == id {
+		t.Errorf("Expected the copy to get a new ID, got %s (%v)", otherID, err)
+	}
+}
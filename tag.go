@@ -0,0 +1,248 @@
+package warded
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tagIndexName is an encrypted cache of the tags of every passphrase,
+// so that filtering by tag doesn't require decrypting every passphrase.
+// Each passphrase's tags are stored along with the hash of its file,
+// and are only used while the file is unchanged.
+const tagIndexName = ".tags"
+
+type tagIndexEntry struct {
+	Hash []byte   `json:"hash"`
+	Tags []string `json:"tags"`
+}
+
+// TagFilter selects passphrases by their tags.
+// A passphrase must match every term of the filter, where a term
+// is a comma-separated list of tags, at least one of which the
+// passphrase must have. Tags starting with ! must not be present.
+// For example, "prod,staging" and "!legacy" select passphrases
+// tagged prod or staging, that aren't also tagged legacy.
+type TagFilter [][]string
+
+// ParseTagFilter parses the terms of a tag filter.
+func ParseTagFilter(terms []string) (TagFilter, error) {
+	filter := make(TagFilter, 0, len(terms))
+	for _, term := range terms {
+		tags := strings.Split(term, ",")
+		for _, tag := range tags {
+			if !fieldName.MatchString(strings.TrimPrefix(tag, "!")) {
+				return nil, fmt.Errorf("Invalid tag %q", tag)
+			}
+		}
+		filter = append(filter, tags)
+	}
+	return filter, nil
+}
+
+// Match returns true if the tags match the filter.
+func (f TagFilter) Match(tags []string) bool {
+	has := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		has[tag] = true
+	}
+
+	for _, term := range f {
+		matched := false
+		for _, tag := range term {
+			if strings.HasPrefix(tag, "!") {
+				matched = !has[tag[1:]]
+			} else {
+				matched = has[tag]
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// AddTags adds tags to a passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) AddTags(passName Name, tags ...string) error {
+	return w.editTags(passName, func(has map[string]bool) error {
+		for _, tag := range tags {
+			if !fieldName.MatchString(tag) {
+				return fmt.Errorf("Invalid tag %q", tag)
+			}
+			has[tag] = true
+		}
+		return nil
+	})
+}
+
+// RemoveTags removes tags from a passphrase.
+// Aliases are followed to the passphrase they point to.
+func (w Ward) RemoveTags(passName Name, tags ...string) error {
+	return w.editTags(passName, func(has map[string]bool) error {
+		for _, tag := range tags {
+			if !has[tag] {
+				return fmt.Errorf("Passphrase %s isn't tagged %s", passName, tag)
+			}
+			delete(has, tag)
+		}
+		return nil
+	})
+}
+
+func (w Ward) editTags(passName Name, edit func(has map[string]bool) error) error {
+	name, env, err := w.resolve(passName)
+	if err != nil {
+		return err
+	}
+
+	has := make(map[string]bool, len(env.Tags))
+	for _, tag := range env.Tags {
+		has[tag] = true
+	}
+	if err = edit(has); err != nil {
+		return err
+	}
+
+	env.Tags = make([]string, 0, len(has))
+	for tag := range has {
+		env.Tags = append(env.Tags, tag)
+	}
+	sort.Strings(env.Tags)
+
+	if err = w.editEnvelope(name, env); err != nil {
+		return err
+	}
+
+	// the index would otherwise be updated the next time it's read
+	hash, err := hashFile(w.Path(name))
+	if err != nil {
+		return err
+	}
+	index := w.readTagIndex()
+	index[string(name)] = tagIndexEntry{Hash: hash, Tags: env.Tags}
+	return w.writeTagIndex(index)
+}
+
+// Tags returns the tags of every passphrase matching the path pattern.
+func (w Ward) Tags(pathPattern string) (map[Name][]string, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil {
+		return nil, err
+	}
+	return w.tagsOf(passphrases)
+}
+
+// ListTagged returns the names of the passphrases matching
+// both the path pattern and the tag filter.
+func (w Ward) ListTagged(pathPattern string, filter TagFilter) ([]Name, error) {
+	passphrases, err := w.mapTagged(pathPattern, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]Name, 0, len(passphrases))
+	for name := range passphrases {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// mapTagged is like Map, but only returns passphrases matching the filter.
+func (w Ward) mapTagged(pathPattern string, filter TagFilter) (map[Name]*Passphrase, error) {
+	passphrases, err := w.Map(pathPattern)
+	if err != nil || len(filter) == 0 {
+		return passphrases, err
+	}
+
+	tags, err := w.tagsOf(passphrases)
+	if err != nil {
+		return nil, err
+	}
+	for name := range passphrases {
+		if !filter.Match(tags[name]) {
+			delete(passphrases, name)
+		}
+	}
+	return passphrases, nil
+}
+
+// tagsOf returns the tags of the passphrases, using the tag index
+// for passphrases that haven't changed since they were indexed.
+// The index is updated with any passphrases that had to be decrypted.
+func (w Ward) tagsOf(passphrases map[Name]*Passphrase) (map[Name][]string, error) {
+	index := w.readTagIndex()
+	changed := false
+
+	tags := make(map[Name][]string, len(passphrases))
+	for name, pass := range passphrases {
+		hash, err := hashFile(pass.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if entry, ok := index[string(name)]; ok && bytes.Equal(entry.Hash, hash) {
+			tags[name] = entry.Tags
+			continue
+		}
+
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		tags[name] = env.Tags
+		index[string(name)] = tagIndexEntry{Hash: hash, Tags: env.Tags}
+		changed = true
+	}
+
+	if changed {
+		// the index is only a cache, so it doesn't matter
+		// if it can't be written, such as by group members
+		w.writeTagIndex(index)
+	}
+	return tags, nil
+}
+
+// readTagIndex returns the tag index, or an empty index
+// if it doesn't exist or can't be decrypted.
+func (w Ward) readTagIndex() map[string]tagIndexEntry {
+	index := make(map[string]tagIndexEntry)
+
+	pass, err := ReadPassphrase(filepath.Join(w.Dir, tagIndexName))
+	if err != nil {
+		return index
+	}
+	data, err := pass.Decrypt(w.key)
+	if err != nil || json.Unmarshal(data, &index) != nil {
+		return make(map[string]tagIndexEntry)
+	}
+	return index
+}
+
+// writeTagIndex writes the tag index, removing passphrases that no longer exist.
+func (w Ward) writeTagIndex(index map[string]tagIndexEntry) error {
+	for name := range index {
+		if _, err := os.Lstat(w.Path(Name(name))); os.IsNotExist(err) {
+			delete(index, name)
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	pass, err := w.newPassphrase(data)
+	if err != nil {
+		return err
+	}
+	pass.Filename = filepath.Join(w.Dir, tagIndexName)
+	return w.writePassphrase(pass)
+}
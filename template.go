@@ -0,0 +1,124 @@
+package warded
+
+import (
+	"fmt"
+	"strings"
+)
+
+// passwordField is the name of the template field
+// that fills the first line of an entry.
+const passwordField = "password"
+
+// TemplateField is a field of a template. Generated fields are
+// generated with the field's policy, while others are prompted for.
+type TemplateField struct {
+	Name     string  `json:"name"`
+	Generate bool    `json:"generate,omitempty"`
+	Policy   *Policy `json:"policy,omitempty"`
+}
+
+// Template is the initial layout of a new entry.
+// A field named password fills the first line of the entry,
+// and Notes is written after the fields.
+type Template struct {
+	Fields []TemplateField `json:"fields"`
+	Notes  string          `json:"notes,omitempty"`
+}
+
+// DefaultTemplates returns the templates that are available
+// without being configured.
+func DefaultTemplates() map[string]Template {
+	return map[string]Template{
+		"login": {Fields: []TemplateField{
+			{Name: passwordField, Generate: true},
+			{Name: "user"},
+			{Name: "url"},
+		}},
+		"credit-card": {Fields: []TemplateField{
+			{Name: passwordField},
+			{Name: "number"},
+			{Name: "name"},
+			{Name: "expiry"},
+			{Name: "cvc"},
+		}},
+		"ssh-key": {
+			Fields: []TemplateField{
+				{Name: passwordField, Generate: true},
+				{Name: "user"},
+				{Name: "host"},
+			},
+			Notes: "\n",
+		},
+		"api-token": {Fields: []TemplateField{
+			{Name: passwordField},
+			{Name: "url"},
+			{Name: "scopes"},
+		}},
+		"database": {Fields: []TemplateField{
+			{Name: passwordField, Generate: true},
+			{Name: "user"},
+			{Name: "host"},
+			{Name: "port"},
+			{Name: "database"},
+		}},
+	}
+}
+
+// Template returns the named template, from the configured
+// templates or the default templates.
+func (c Config) Template(name string) (Template, error) {
+	if template, ok := c.Templates[name]; ok {
+		return template, nil
+	}
+	if template, ok := DefaultTemplates()[name]; ok {
+		return template, nil
+	}
+	return Template{}, fmt.Errorf("Unknown template %s", name)
+}
+
+// Validate checks that the template's field names are valid.
+func (t Template) Validate() error {
+	for _, field := range t.Fields {
+		if !fieldName.MatchString(field.Name) {
+			return fmt.Errorf("Invalid field name %q in template", field.Name)
+		}
+		if field.Policy != nil {
+			if err := field.Policy.Validate(); err != nil {
+				return fmt.Errorf("Field %s: %s", field.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Entry fills in the template, using value to prompt for or
+// generate the value of each field, in the template's order.
+// Generated fields without a policy use the default policy.
+func (t Template) Entry(defaultPolicy Policy, value func(field TemplateField, policy Policy) (string, error)) (*Entry, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{Notes: t.Notes, hasNotes: t.Notes != ""}
+	for _, field := range t.Fields {
+		policy := defaultPolicy
+		if field.Policy != nil {
+			policy = *field.Policy
+		}
+
+		v, err := value(field, policy)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("Field %s can't contain a newline", field.Name)
+		}
+
+		if strings.EqualFold(field.Name, passwordField) {
+			entry.Password = v
+		} else if err = entry.SetField(field.Name, v); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
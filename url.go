@@ -0,0 +1,211 @@
+package warded
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// urlField is the entry field that find-url compares against.
+const urlField = "url"
+
+// URLStrictness is how closely the host of an entry's url field
+// has to match the host being looked up.
+type URLStrictness int
+
+// Strictness levels, from the strictest to the most lenient.
+// MatchExact requires the same host. MatchSubdomain also allows
+// the host to be a subdomain of the entry's host, and MatchDomain
+// allows any host with the same registrable domain, such as
+// example.co.uk for login.example.co.uk.
+const (
+	MatchExact URLStrictness = iota
+	MatchSubdomain
+	MatchDomain
+)
+
+var strictnessNames = []string{"exact", "subdomain", "domain"}
+
+func (s URLStrictness) String() string {
+	if int(s) < len(strictnessNames) {
+		return strictnessNames[s]
+	}
+	return fmt.Sprintf("URLStrictness(%d)", int(s))
+}
+
+// MarshalText marshals the strictness level by name.
+func (s URLStrictness) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseURLStrictness parses the name of a strictness level.
+// An empty name is MatchDomain.
+func ParseURLStrictness(s string) (URLStrictness, error) {
+	if s == "" {
+		return MatchDomain, nil
+	}
+	for i, name := range strictnessNames {
+		if s == name {
+			return URLStrictness(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid URL match %s", s)
+}
+
+// URLMatch is a passphrase with a url field matching a looked up URL.
+// Match is the strictest level the url field matches at.
+type URLMatch struct {
+	Name  Name          `json:"name"`
+	URL   string        `json:"url"`
+	Match URLStrictness `json:"match"`
+
+	// path is the length of the path prefix that matched,
+	// and scheme is set if the scheme matched, used for ranking
+	path   int
+	scheme bool
+}
+
+// parseURL parses a URL, which can be given without a scheme.
+func parseURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid URL %s", rawURL)
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u, nil
+}
+
+// defaultPorts are the ports implied by the scheme of a URL.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// urlPort returns the port of a URL, or the default port of its scheme.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	return defaultPorts[u.Scheme]
+}
+
+// matchURL returns the strictest level at which the entry's URL
+// matches the looked up URL, and false if it doesn't match.
+// A port in the entry's URL has to match exactly, where
+// a URL without a port uses the default port of its scheme.
+func matchURL(entry, target *url.URL) (URLStrictness, bool) {
+	if entry.Port() != "" && urlPort(entry) != urlPort(target) {
+		return 0, false
+	}
+
+	host, other := target.Hostname(), entry.Hostname()
+	if host == other {
+		return MatchExact, true
+	}
+	// an entry without a registrable domain, such as a public suffix,
+	// would otherwise match the subdomains of every domain under it
+	if _, err := publicsuffix.EffectiveTLDPlusOne(other); err == nil && strings.HasSuffix(host, "."+other) {
+		return MatchSubdomain, true
+	}
+
+	// hosts without a registrable domain, such as IP addresses
+	// or bare public suffixes, only match exactly
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return 0, false
+	}
+	if otherDomain, err := publicsuffix.EffectiveTLDPlusOne(other); err == nil && domain == otherDomain {
+		return MatchDomain, true
+	}
+	return 0, false
+}
+
+// FindURL returns the passphrases with a url field matching the URL
+// at the given strictness. Matches are ranked by strictness level,
+// then by the longest matching path and by matching scheme.
+// Aliases are skipped, since they would match like their target.
+func (w Ward) FindURL(rawURL string, strictness URLStrictness) ([]URLMatch, error) {
+	target, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrases, err := w.Map("")
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]URLMatch, 0)
+	for name, pass := range passphrases {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return nil, err
+		}
+		if env.Alias != "" {
+			continue
+		}
+
+		var best *URLMatch
+		for _, field := range ParseEntry(env.Content).Fields {
+			if !strings.EqualFold(field.Name, urlField) {
+				continue
+			}
+
+			u, err := parseURL(field.Value)
+			if err != nil {
+				// entries can contain anything, so an invalid
+				// url field is just never matched
+				continue
+			}
+			level, ok := matchURL(u, target)
+			if !ok || level > strictness {
+				continue
+			}
+
+			match := URLMatch{
+				Name:   name,
+				URL:    field.Value,
+				Match:  level,
+				scheme: !strings.Contains(field.Value, "://") || u.Scheme == target.Scheme,
+			}
+			if path := strings.TrimSuffix(u.Path, "/"); hasPathPrefix(target.Path, path) {
+				match.path = len(path)
+			}
+			if best == nil || match.before(*best) {
+				best = &match
+			}
+		}
+		if best != nil {
+			matches = append(matches, *best)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].before(matches[j])
+	})
+	return matches, nil
+}
+
+// hasPathPrefix returns true if the path starts with every segment of the prefix.
+func hasPathPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// before returns true if the match ranks before the other match.
+func (m URLMatch) before(other URLMatch) bool {
+	switch {
+	case m.Match != other.Match:
+		return m.Match < other.Match
+	case m.path != other.path:
+		return m.path > other.path
+	case m.scheme != other.scheme:
+		return m.scheme
+	}
+	return m.Name < other.Name
+}
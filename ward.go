@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"math/big"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -17,10 +16,14 @@ import (
 )
 
 // Ward holds data needed to work with a ward.
+// ExpectManifest is set when the ward is known to have had a manifest,
+// so that a missing manifest isn't recreated from the current contents
+// of the ward, which may have been tampered with.
 type Ward struct {
-	Config WardConfig
-	Dir    string
-	key    []byte
+	Config         WardConfig
+	Dir            string
+	ExpectManifest bool
+	key            []byte
 }
 
 // NewWard creates a Ward.
@@ -32,7 +35,7 @@ func NewWard() Ward {
 
 // SearchResult contains information about a matched search
 type SearchResult struct {
-	Passphrase string
+	Passphrase Name
 	Line       []byte
 	LineNum    int
 	IndexStart int
@@ -49,108 +52,219 @@ type Statistics struct {
 
 // A Group holds the names and some statistics about a group of common passphrases
 type Group struct {
-	Length      int      `json:"len"`
-	Passphrases []string `json:"pass"`
+	Length      int    `json:"len"`
+	Passphrases []Name `json:"pass"`
 }
 
 func (w *Ward) SetKey(key []byte) {
 	w.key = key
 }
 
+// Copy copies the encrypted passphrase to a new name.
+// Attachments are copied, rather than shared between the passphrases.
+func (w Ward) Copy(srcPassName, destPassName Name) error {
+	src, err := w.path(srcPassName)
+	if err != nil {
+		return err
+	}
+	dest, err := w.path(destPassName)
+	if err != nil {
+		return err
+	}
+
+	pass, err := ReadPassphrase(src)
+	if err != nil {
+		return err
+	}
+
+	if pass.Version > 0 {
+		env, err := pass.open(w.key)
+		if err != nil {
+			return err
+		}
+		if len(env.Attachments) > 0 {
+			if err = w.duplicateAttachments(env); err != nil {
+				return err
+			}
+			return w.editEnvelope(destPassName, env)
+		}
+	}
+
+	pass.Filename = dest
+	return w.writeTracked(destPassName, pass)
+}
+
 // Edit sets the entire content of the warded passphrase.
-func (w Ward) Edit(passName string, content []byte) (err error) {
-	var pass *Passphrase
-	if pass, err = w.newPassphrase(content); err == nil {
-		pass.Filename = w.Path(passName)
-		err = pass.Write(0600)
+// Editing an alias edits the passphrase it points to.
+func (w Ward) Edit(passName Name, content []byte) error {
+	name, env, err := w.resolve(passName)
+	if os.IsNotExist(err) {
+		env = newEnvelope()
+	} else if err != nil {
+		return err
+	} else if !bytes.Equal(env.Content, content) {
+		env.modified()
 	}
-	return
+
+	env.Content = content
+	return w.editEnvelope(name, env)
 }
 
 // Get returns the decrypted passphrase content.
-func (w Ward) Get(passName string) ([]byte, error) {
-	warded, err := ReadPassphrase(w.Path(passName))
+// Aliases are followed to the passphrase they point to.
+func (w Ward) Get(passName Name) ([]byte, error) {
+	_, env, err := w.resolve(passName)
 	if err != nil {
 		return nil, err
 	}
-	return warded.Decrypt(w.key)
+	return env.Content, nil
 }
 
 // GetOrCheck returns the decrypted passphrase content.
-// If Get throws an error, the Ward's key is checked
-// against a random passphrase in the Ward.
-func (w Ward) GetOrCheck(passName string) ([]byte, error) {
+// If Get throws an error, the Ward's key is checked with CheckKey.
+func (w Ward) GetOrCheck(passName Name) ([]byte, error) {
 	pass, err := w.Get(passName)
 	if err != nil {
-		err = w.checkKey()
+		err = w.CheckKey()
 	}
 	return pass, err
 }
 
-// List returns a list of passphrase names in the ward
-func (w Ward) List(pathPattern string) ([]string, error) {
-	passphrases := make([]string, 0)
+// List returns a list of passphrase names in the ward.
+// Files that aren't passphrases are skipped.
+func (w Ward) List(pathPattern string) ([]Name, error) {
+	passphrases := make([]Name, 0)
 
-	e := w.walkPathPattern(pathPattern, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		var rel string
+	e := w.walkEntries(pathPattern, func(name Name, pass *Passphrase) error {
+		passphrases = append(passphrases, name)
+		return nil
+	}, nil)
 
-		if !info.IsDir() {
-			if rel, err = filepath.Rel(w.Dir, p); err != nil {
-				return err
-			}
+	return passphrases, e
+}
 
-			passphrases = append(passphrases, rel)
-		}
+// Map returns a map of passphrase names to the warded passphrase.
+// Files that aren't passphrases are skipped.
+func (w Ward) Map(pathPattern string) (map[Name]*Passphrase, error) {
+	passphrases := make(map[Name]*Passphrase)
 
+	e := w.walkEntries(pathPattern, func(name Name, pass *Passphrase) error {
+		passphrases[name] = pass
 		return nil
-	})
+	}, nil)
 
 	return passphrases, e
 }
 
-// Map returns a map of passphrase names to the warded passphrase.
-func (w Ward) Map(pathPattern string) (map[string]*Passphrase, error) {
-	passphrases := make(map[string]*Passphrase)
+// Move renames a passphrase or a group of passphrases.
+// An existing destination isn't replaced, since its attachments would be orphaned.
+func (w Ward) Move(srcPassName, destPassName Name) error {
+	src, err := w.path(srcPassName)
+	if err != nil {
+		return err
+	}
+	dest, err := w.path(destPassName)
+	if err != nil {
+		return err
+	}
+	if srcPassName != destPassName && srcPassName.Contains(destPassName) {
+		return fmt.Errorf("Can't move %s into itself", srcPassName)
+	}
 
-	e := w.walkPathPattern(pathPattern, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
+	unlock, err := w.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if srcPassName != destPassName {
+		if _, err = os.Lstat(dest); err == nil {
+			return fmt.Errorf("Passphrase %s already exists", destPassName)
+		} else if !os.IsNotExist(err) {
 			return err
 		}
+	}
+	if err = w.mkdirAll(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err = os.Rename(src, dest); err != nil {
+		return err
+	}
 
-		var rel string
-		var pass *Passphrase
-
-		if !info.IsDir() {
-			if rel, err = filepath.Rel(w.Dir, p); err != nil {
-				return err
-			}
-
-			if pass, err = ReadPassphrase(w.Path(rel)); err != nil {
-				return err
+	err = w.updateManifest(func(entries map[string][]byte) error {
+		for name, hash := range entries {
+			if srcPassName.Contains(Name(name)) {
+				delete(entries, name)
+				entries[string(destPassName)+name[len(srcPassName):]] = hash
 			}
-
-			passphrases[rel] = pass
 		}
 		return nil
 	})
-
-	return passphrases, e
+	if err != nil {
+		// the ward must still match its manifest
+		os.Rename(dest, src)
+	}
+	return err
 }
 
 // Path returns the path to a passphrase.
-// Generated by joining the ward directory with the cleaned passphrase name
-func (w Ward) Path(passName string) string {
-	clean := strings.TrimLeft(filepath.Clean(passName), "."+string(filepath.Separator))
-	return path.Join(w.Dir, clean)
+// Generated by joining the ward directory with the passphrase name
+func (w Ward) Path(passName Name) string {
+	return filepath.Join(w.Dir, filepath.FromSlash(string(passName)))
+}
+
+// Remove deletes a passphrase from the ward, along with its attachments.
+func (w Ward) Remove(passName Name) error {
+	p, err := w.path(passName)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := w.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var attachments []attachment
+	if env, err := w.readEnvelope(passName); err == nil {
+		attachments = env.Attachments
+	}
+
+	old, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil {
+		return err
+	}
+
+	err = w.updateManifest(func(entries map[string][]byte) error {
+		delete(entries, string(passName))
+		return nil
+	})
+	if err != nil {
+		// the ward must still match its manifest
+		w.writeFile(p, old)
+		return err
+	}
+	for _, att := range attachments {
+		if err == nil {
+			err = os.Remove(w.attachmentPath(att.ID))
+		}
+	}
+	return err
 }
 
 // Rekey changes the master key for the entire ward.
 // Any errors will cancel the operation, leaving the ward with the existing key.
 func (w Ward) Rekey(newMasterKey []byte, tempDir string) error {
+	unlock, err := w.lockManifest()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	passphrases, err := w.Map("")
 	if err != nil {
 		return err
@@ -160,7 +274,16 @@ func (w Ward) Rekey(newMasterKey []byte, tempDir string) error {
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpDir)
+	// the temp dir is kept if files couldn't be moved back to the ward
+	keepTmp := false
+	defer func() {
+		if !keepTmp {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	if err = w.Config.setPerms(tmpDir, w.Config.dirMode()); err != nil {
+		return err
+	}
 
 	newWard := NewWard()
 	newWard.SetKey(newMasterKey)
@@ -168,28 +291,137 @@ func (w Ward) Rekey(newMasterKey []byte, tempDir string) error {
 	newWard.Dir = tmpDir
 
 	var plaintext []byte
+	var pass *Passphrase
+	entries := make(map[string][]byte, len(passphrases))
 	for passName, warded := range passphrases {
-		if plaintext, err = warded.Decrypt(w.key); err != nil {
+		if plaintext, err = warded.decrypt(w.key); err != nil {
 			return fmt.Errorf("Invalid master key for %s", passName)
 		}
 
-		if err = newWard.Edit(passName, plaintext); err != nil {
+		// the plaintext is re-encrypted as is, keeping the envelope
+		if pass, err = newWard.newPassphrase(plaintext); err != nil {
+			return err
+		}
+		pass.Version = warded.Version
+		pass.Filename = newWard.Path(passName)
+
+		if err = newWard.writePassphrase(pass); err != nil {
+			return err
+		}
+		if err = newWard.hashEntry(entries, passName); err != nil {
 			return err
 		}
 	}
 
-	if err = os.RemoveAll(w.Dir); err == nil {
-		err = os.Rename(tmpDir, w.Dir)
+	// the manifest version carries on from the existing ward,
+	// so that the rekeyed ward isn't mistaken for a rollback
+	var version uint64
+	if m, err := w.readManifest(); err == nil {
+		version = m.Version
+	} else if os.IsNotExist(err) && w.ExpectManifest {
+		return ErrManifestMissing
+	}
+	if err = newWard.writeManifest(version+1, entries); err != nil {
+		return err
+	}
+
+	// the sync bases are re-encrypted, while the header, attachments
+	// and any other files that aren't passphrases are moved as is
+	if err = w.migrateSyncBase(); err != nil {
+		return err
+	}
+	bases, err := w.readSyncBases()
+	if err != nil {
+		return err
+	}
+	for peer, base := range bases {
+		if err = newWard.writeSyncBase(peer, base); err != nil {
+			return err
+		}
+	}
+
+	// the existing ward is only removed once the new one is in place
+	oldDir := tmpDir + ".old"
+	moved, err := w.moveOthers(tmpDir, passphrases)
+	if err == nil {
+		if err = os.Rename(w.Dir, oldDir); err == nil {
+			if err = os.Rename(tmpDir, w.Dir); err == nil {
+				if err = os.RemoveAll(oldDir); err != nil {
+					return fmt.Errorf("Failed to remove the previous ward in %s: %s", oldDir, err)
+				}
+				return nil
+			}
+			if restoreErr := os.Rename(oldDir, w.Dir); restoreErr != nil {
+				keepTmp = true
+				return fmt.Errorf("Failed to restore the ward from %s: %s", oldDir, restoreErr)
+			}
+		}
+	}
+
+	// put back the moved files, so that they aren't removed with the temp dir
+	for i := len(moved) - 1; i >= 0; i-- {
+		if restoreErr := os.Rename(filepath.Join(tmpDir, moved[i]), filepath.Join(w.Dir, moved[i])); restoreErr != nil {
+			keepTmp = true
+			return fmt.Errorf("Failed to restore %s from %s: %s", moved[i], tmpDir, restoreErr)
+		}
 	}
 	return err
 }
 
+// moveOthers moves every file and directory in the ward that doesn't
+// contain passphrases into dir, except for the manifest, sync bases,
+// tag index and temporary files, which are replaced or discarded.
+// The names of the moved files are returned, even on failure.
+func (w Ward) moveOthers(dir string, passphrases map[Name]*Passphrase) ([]string, error) {
+	var moved []string
+
+	err := filepath.Walk(w.Dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(w.Dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		name := info.Name()
+		switch {
+		case rel == manifestName || rel == syncDir || rel == tagIndexName || strings.HasPrefix(name, ".tmp-"):
+			return nil
+		case filepath.Dir(rel) == syncDir && name != syncIDName:
+			return nil
+		case info.IsDir() && !strings.HasPrefix(name, "."):
+			// directories may contain passphrases, so they're walked
+			return nil
+		case passphrases[Name(filepath.ToSlash(rel))] != nil:
+			return nil
+		}
+
+		if err = w.mkdirAll(filepath.Dir(filepath.Join(dir, rel))); err != nil {
+			return err
+		}
+		if err = os.Rename(p, filepath.Join(dir, rel)); err != nil {
+			return err
+		}
+		moved = append(moved, rel)
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	return moved, err
+}
+
 // Search searches through a ward, printing lines
 // that match the given regular expression.
-func (w Ward) Search(path string, regex *regexp.Regexp) ([]SearchResult, error) {
+// Only passphrases matching the tag filter are searched.
+func (w Ward) Search(path string, filter TagFilter, regex *regexp.Regexp) ([]SearchResult, error) {
 	var err error
-	var passphrases map[string]*Passphrase
-	if passphrases, err = w.Map(path); err != nil {
+	var passphrases map[Name]*Passphrase
+	if passphrases, err = w.mapTagged(path, filter); err != nil {
 		return nil, err
 	}
 
@@ -217,26 +449,32 @@ func (w Ward) Search(path string, regex *regexp.Regexp) ([]SearchResult, error)
 }
 
 // Stats returns statistics for the current ward.
-func (w Ward) Stats(path string) (*Statistics, error) {
-	passphrases, err := w.Map(path)
+// Only passphrases matching the tag filter are included.
+func (w Ward) Stats(path string, filter TagFilter) (*Statistics, error) {
+	passphrases, err := w.mapTagged(path, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	groupMap := make(map[string][]string)
+	groupMap := make(map[string][]Name)
+	count := 0
 	sumLen := 0
 	maxLen := 0
 
 	for name, pass := range passphrases {
-		plaintext, err := pass.Decrypt(w.key)
+		env, err := pass.open(w.key)
 		if err != nil {
 			return nil, err
 		}
-		lines := bytes.SplitN(plaintext, []byte("\n"), 2)
+		if env.Alias != "" {
+			continue
+		}
+		lines := bytes.SplitN(env.Content, []byte("\n"), 2)
 		first := string(lines[0])
 		passLen := len(first)
 
 		groupMap[first] = append(groupMap[first], name)
+		count++
 
 		if passLen > maxLen {
 			maxLen = passLen
@@ -258,37 +496,64 @@ func (w Ward) Stats(path string) (*Statistics, error) {
 
 	return &Statistics{
 		Groups:    groups,
-		Count:     len(passphrases),
+		Count:     count,
 		MaxLength: maxLen,
 		SumLength: sumLen,
 	}, nil
 }
 
-// Update replaces the first line of a passphrase with the given string.
-func (w Ward) Update(passName string, passStr []byte) ([]byte, error) {
-	pass, err := w.GetOrCheck(passName)
+// Update replaces the first line of a passphrase with the given string,
+// creating the passphrase if it doesn't exist.
+// The passphrase is recorded as rotated in its metadata, and the old
+// password is kept as configured by KeepPrevious.
+func (w Ward) Update(passName Name, passStr []byte) ([]byte, error) {
+	return w.UpdateKeeping(passName, passStr, w.Config.KeepPrevious)
+}
+
+// UpdateKeeping is like Update, but keeps up to keep previous passwords,
+// including the one being replaced. If keep is 0, the previous
+// passwords are left as they are.
+func (w Ward) UpdateKeeping(passName Name, passStr []byte, keep int) ([]byte, error) {
+	name, env, err := w.resolve(passName)
+	existed := err == nil
+	if os.IsNotExist(err) {
+		err = w.CheckKey()
+		env = newEnvelope()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	newPass := passStr
+	entry := ParseEntry(env.Content)
+	oldPass := entry.Password
+	entry.Password = string(passStr)
 
-	split := bytes.SplitN(pass, []byte("\n"), 2)
-	if len(split) != 1 {
-		newPass = append(newPass, '\n')
-		newPass = append(newPass, split[1]...)
+	env.Content = entry.Bytes()
+	env.modified()
+	if existed && keep > 0 {
+		env.keepPrevious(oldPass, keep)
 	}
-
-	if err = w.Edit(passName, newPass); err != nil {
+	env.Metadata.Rotated = env.Metadata.Modified
+	if err = w.editEnvelope(name, env); err != nil {
 		return nil, err
 	}
 
-	return split[0], nil
+	return []byte(oldPass), nil
 }
 
-// checkKey attempts to decrypt a random passphrase in the ward
-func (w Ward) checkKey() (err error) {
-	var passphrases []string
+// CheckKey checks that the Ward's key is the ward's master key.
+// The manifest is authenticated with the key if it exists.
+// Otherwise, the key is used to decrypt a random passphrase in the ward.
+func (w Ward) CheckKey() (err error) {
+	if _, err = w.Manifest(); err == nil {
+		return
+	} else if err == ErrManifestMAC {
+		return fmt.Errorf("Only one master key is allowed per ward")
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	var passphrases []Name
 	if passphrases, err = w.List(""); err != nil {
 		return
 	}
@@ -322,9 +587,23 @@ func (w Ward) walkPathPattern(pathPattern string, walkFn filepath.WalkFunc) erro
 	var err error
 	var paths []string
 
-	if paths, err = doublestar.Glob(w.Path(pathPattern)); err == nil {
+	// names starting with a dot are reserved for ward metadata,
+	// such as the manifest, and are never passphrases
+	skipReserved := func(p string, info os.FileInfo, err error) error {
+		if p != w.Dir && strings.HasPrefix(filepath.Base(p), ".") {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return walkFn(p, info, err)
+	}
+
+	// patterns are cleaned, so that they can't lead outside of the ward
+	clean := strings.TrimLeft(filepath.Clean(pathPattern), "."+string(filepath.Separator))
+	if paths, err = doublestar.Glob(filepath.Join(w.Dir, clean)); err == nil {
 		for _, path := range paths {
-			err = filepath.Walk(path, walkFn)
+			err = filepath.Walk(path, skipReserved)
 
 			if err != nil {
 				return err
@@ -0,0 +1,167 @@
+package warded
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"time"
+)
+
+// EventType is the type of change reported by Watch.
+type EventType int
+
+// Changes to a ward reported by Watch.
+// EventRekeyed replaces every other event, since all
+// of the passphrases are rewritten by Rekey.
+const (
+	EventCreated EventType = iota + 1
+	EventModified
+	EventRemoved
+	EventRenamed
+	EventRekeyed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventModified:
+		return "modified"
+	case EventRemoved:
+		return "removed"
+	case EventRenamed:
+		return "renamed"
+	case EventRekeyed:
+		return "rekeyed"
+	}
+	return "unknown"
+}
+
+// Event is a change to a passphrase in a ward.
+// OldName is only set for EventRenamed,
+// while Name isn't set for EventRekeyed.
+type Event struct {
+	Type    EventType
+	Name    Name
+	OldName Name
+}
+
+// watchDelay is how long the ward must be left unchanged before
+// it's compared against its previous state, so that the temporary
+// files written by the ward are never reported.
+const watchDelay = 100 * time.Millisecond
+
+// Watch reports changes to the passphrases in the ward until the
+// context is cancelled, at which point the channel is closed.
+// Changes are found by comparing the ward against its previous state
+// once it has settled, so a passphrase that's written several times
+// in quick succession is only reported once.
+func (w Ward) Watch(ctx context.Context) (<-chan Event, error) {
+	prev, err := w.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(chan struct{}, 1)
+	if err = w.notify(ctx, changed); err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+
+		timer := time.NewTimer(watchDelay)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-changed:
+				if !ok {
+					return
+				}
+				timer.Reset(watchDelay)
+			case <-timer.C:
+				// the ward may be in the middle of being replaced by Rekey,
+				// in which case it's checked again once it has been moved
+				next, err := w.snapshot()
+				if err != nil {
+					continue
+				}
+				for _, event := range prev.diff(next) {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+				prev = next
+			}
+		}
+	}()
+	return events, nil
+}
+
+// wardSnapshot is the state of a ward, as seen by Watch.
+type wardSnapshot struct {
+	root    os.FileInfo
+	entries map[string][]byte
+}
+
+func (w Ward) snapshot() (*wardSnapshot, error) {
+	root, err := os.Stat(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := w.hashEntries()
+	if err != nil {
+		return nil, err
+	}
+	return &wardSnapshot{root, entries}, nil
+}
+
+// diff returns the events that turn the snapshot into next.
+// A removed passphrase with the same hash as a created
+// passphrase is reported as renamed.
+func (s wardSnapshot) diff(next *wardSnapshot) []Event {
+	if !os.SameFile(s.root, next.root) {
+		return []Event{{Type: EventRekeyed}}
+	}
+
+	var created, removed []string
+	var events []Event
+	for name, hash := range next.entries {
+		if prev, ok := s.entries[name]; !ok {
+			created = append(created, name)
+		} else if !bytes.Equal(prev, hash) {
+			events = append(events, Event{Type: EventModified, Name: Name(name)})
+		}
+	}
+	for name := range s.entries {
+		if _, ok := next.entries[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(removed)
+
+	for _, name := range created {
+		event := Event{Type: EventCreated, Name: Name(name)}
+		for i, old := range removed {
+			if bytes.Equal(s.entries[old], next.entries[name]) {
+				event = Event{Type: EventRenamed, Name: Name(name), OldName: Name(old)}
+				removed = append(removed[:i], removed[i+1:]...)
+				break
+			}
+		}
+		events = append(events, event)
+	}
+	for _, name := range removed {
+		events = append(events, Event{Type: EventRemoved, Name: Name(name)})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package warded
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// notify signals changed whenever the ward may have changed,
+// using inotify to watch every directory in the ward.
+// changed is closed once the context is cancelled.
+func (w Ward) notify(ctx context.Context, changed chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	// the parent directory is watched, so that the ward
+	// can be watched again once Rekey has replaced it
+	parent, err := unix.InotifyAddWatch(fd, filepath.Dir(w.Dir), unix.IN_CREATE|unix.IN_MOVED_TO|unix.IN_ONLYDIR)
+	if err == nil {
+		err = w.addWatches(fd)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	go func() {
+		defer close(changed)
+
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+
+			// new directories need to be watched as well
+			rewatch := false
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				if int(event.Wd) == parent || event.Mask&(unix.IN_ISDIR|unix.IN_IGNORED) != 0 {
+					rewatch = true
+				}
+				off += unix.SizeofInotifyEvent + int(event.Len)
+			}
+			if rewatch {
+				w.addWatches(fd)
+			}
+
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// addWatches watches every directory in the ward, except for reserved directories.
+// Directories that are already watched keep their existing watch.
+func (w Ward) addWatches(fd int) error {
+	return filepath.Walk(w.Dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || !info.IsDir() {
+			return err
+		}
+		if p != w.Dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if _, err = unix.InotifyAddWatch(fd, p, inotifyMask|unix.IN_ONLYDIR); err == unix.ENOENT {
+			return nil
+		}
+		return err
+	})
+}
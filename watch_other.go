@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package warded
+
+import (
+	"context"
+	"time"
+)
+
+// watchInterval is how often the ward is checked for changes,
+// on systems where inotify isn't available.
+const watchInterval = 2 * time.Second
+
+// notify signals changed periodically, since there's no
+// portable way of being notified about changes to the ward.
+// changed is closed once the context is cancelled.
+func (w Ward) notify(ctx context.Context, changed chan<- struct{}) error {
+	go func() {
+		defer close(changed)
+
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
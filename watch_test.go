@@ -0,0 +1,166 @@
+package warded
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func tempWard(t *testing.T) Ward {
+	dir, err := ioutil.TempDir("", "warded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	w := NewWard()
+	w.Config.KeyDerivation.Data = &Scrypt{Iterations: 1024, BlockSize: 8, Parallel: 1}
+	w.Dir = filepath.Join(dir, "ward")
+	if err = os.Mkdir(w.Dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	w.SetKey([]byte("master key"))
+	return w
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	root, err := os.Stat(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := wardSnapshot{root, map[string][]byte{
+		"a":     []byte("1"),
+		"b":     []byte("2"),
+		"g/c":   []byte("3"),
+		"g/old": []byte("4"),
+	}}
+	next := &wardSnapshot{root, map[string][]byte{
+		"a":     []byte("1"),
+		"b":     []byte("5"),
+		"d":     []byte("6"),
+		"h/new": []byte("4"),
+	}}
+
+	expected := []Event{
+		{Type: EventModified, Name: "b"},
+		{Type: EventCreated, Name: "d"},
+		{Type: EventRemoved, Name: "g/c"},
+		{Type: EventRenamed, Name: "h/new", OldName: "g/old"},
+	}
+	if events := prev.diff(next); !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+
+	if events := prev.diff(&prev); len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
+}
+
+func TestSnapshotDiffRekeyed(t *testing.T) {
+	w := tempWard(t)
+	prev, err := w.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rekey replaces the ward directory
+	if err = os.Rename(w.Dir, w.Dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(w.Dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	next, err := w.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{{Type: EventRekeyed}}
+	if events := prev.diff(next); !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+}
+
+// collectEvents returns the events received until none
+// have been received for a while.
+func collectEvents(events <-chan Event, wait time.Duration) []Event {
+	var received []Event
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(wait):
+			return received
+		}
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Watch waits for changes to settle")
+	}
+
+	w := tempWard(t)
+	if err := w.Edit("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := w.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ward is only checked periodically without inotify
+	wait := 5 * watchDelay
+	if runtime.GOOS != "linux" {
+		wait = 3 * time.Second
+	}
+
+	// writes in quick succession are reported once, without
+	// the temporary files written along the way
+	for _, content := range []string{"2", "3", "4"} {
+		if err = w.Edit("a", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Edit("b", []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Type: EventModified, Name: "a"},
+		{Type: EventCreated, Name: "b"},
+	}
+	if received := collectEvents(events, wait); !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected %v, got %v", expected, received)
+	}
+
+	// a passphrase that's changed and changed back isn't reported
+	pass, err := ReadPassphrase(w.Path("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(pass.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Edit("b", []byte("6")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pass.Filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if received := collectEvents(events, wait); len(received) != 0 {
+		t.Errorf("Expected no events, got %v", received)
+	}
+
+	cancel()
+	for range events {
+	}
+}